@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+)
+
+// accessLogger writes one JSON record per websocket connection and, when
+// enabled, per sampled pixel placement, for offline analytics. It is
+// separate from the diagnostic log so the two can be routed and retained
+// independently. A nil *accessLogger logs nothing.
+//
+// Records never contain session IDs, which are bearer tokens for resuming a
+// session, nor the request query, which carries the session and the
+// Turnstile token. Connections are identified by client ID and a hash of the
+// session instead.
+type accessLogger struct {
+	log *slog.Logger
+	// placementRate is the fraction of placements logged, from 0 (none) to
+	// 1 (all).
+	placementRate float64
+}
+
+func newAccessLogger(w io.Writer, placementRate float64) *accessLogger {
+	return &accessLogger{
+		log:           slog.New(slog.NewJSONHandler(w, nil)),
+		placementRate: placementRate,
+	}
+}
+
+// sessionHash returns a short digest of session that correlates records
+// without revealing the session ID.
+func sessionHash(session sessionID) string {
+	sum := sha256.Sum256(session[:])
+	return hex.EncodeToString(sum[:8])
+}
+
+// connection records a new websocket connection.
+func (a *accessLogger) connection(c *Client, r *http.Request, resumed bool) {
+	if a == nil {
+		return
+	}
+	a.log.Info("connection",
+		"remote_ip", c.ip,
+		"client_id", c.id,
+		"session_hash", sessionHash(c.session),
+		"resumed", resumed,
+		"user_agent", r.UserAgent(),
+		"origin", r.Header.Get("Origin"),
+	)
+}
+
+// placement records p, placed by c, subject to sampling.
+func (a *accessLogger) placement(c *Client, p placement) {
+	if a == nil || a.placementRate <= 0 || (a.placementRate < 1 && rand.Float64() >= a.placementRate) {
+		return
+	}
+	a.log.Info("placement",
+		"remote_ip", c.ip,
+		"client_id", c.id,
+		"session_hash", sessionHash(c.session),
+		"panel", p.Panel,
+		"x", p.X,
+		"y", p.Y,
+		"r", p.R,
+		"g", p.G,
+		"b", p.B,
+		"ts", p.Timestamp,
+	)
+}
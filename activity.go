@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// activityBucket is the granularity of the rolling activity window.
+const activityBucket = time.Second
+
+// activityTracker counts pixel updates per panel over a rolling window. The
+// window is split into one-second buckets; run ages out the oldest bucket
+// every second.
+type activityTracker struct {
+	window  time.Duration
+	mu      sync.Mutex
+	buckets [][]uint32
+	cur     int
+	totals  []uint32
+}
+
+func newActivityTracker(window time.Duration) *activityTracker {
+	n := int((window + activityBucket - 1) / activityBucket)
+	if n < 1 {
+		n = 1
+	}
+	buckets := make([][]uint32, n)
+	for i := range buckets {
+		buckets[i] = make([]uint32, numPanels)
+	}
+	return &activityTracker{
+		window:  time.Duration(n) * activityBucket,
+		buckets: buckets,
+		totals:  make([]uint32, numPanels),
+	}
+}
+
+// record counts n updates to panel.
+func (a *activityTracker) record(panel, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buckets[a.cur][panel] += uint32(n)
+	a.totals[panel] += uint32(n)
+}
+
+// run advances the window once per bucket, forever.
+func (a *activityTracker) run() {
+	ticker := time.NewTicker(activityBucket)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.mu.Lock()
+		a.cur = (a.cur + 1) % len(a.buckets)
+		expired := a.buckets[a.cur]
+		for i, n := range expired {
+			a.totals[i] -= n
+		}
+		clear(expired)
+		a.mu.Unlock()
+	}
+}
+
+// panelActivity is the update count of one panel in an /activity response.
+type panelActivity struct {
+	Panel   int    `json:"panel"`
+	Updates uint32 `json:"updates"`
+}
+
+// serveActivity lists the panels updated within the activity window, busiest
+// first.
+func serveActivity(a *activityTracker, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	panels := []panelActivity{}
+	a.mu.Lock()
+	for i, n := range a.totals {
+		if n > 0 {
+			panels = append(panels, panelActivity{Panel: i, Updates: n})
+		}
+	}
+	a.mu.Unlock()
+	sort.Slice(panels, func(i, j int) bool {
+		if panels[i].Updates != panels[j].Updates {
+			return panels[i].Updates > panels[j].Updates
+		}
+		return panels[i].Panel < panels[j].Panel
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		WindowSeconds int             `json:"window_seconds"`
+		Panels        []panelActivity `json:"panels"`
+	}{int(a.window / time.Second), panels})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// requireAdmin wraps an admin handler so it only runs for requests with the
+// given method carrying "Authorization: Bearer <token>". An empty token
+// disables the endpoint entirely.
+func requireAdmin(token, method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clearCanvas resets every pixel of the canvas to the background.
+func clearCanvas() {
+	for i := range panels {
+		panelLocks[i].Lock()
+		panels[i].clear()
+		invalidatePanel(i)
+		panelLocks[i].Unlock()
+	}
+	markAllPanelsDirty()
+}
+
+// serveAdminReset clears every pixel of the canvas, logs the reset so that
+// replaying the placement log does not undo it, and tells connected clients
+// to re-request their panels.
+func serveAdminReset(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	clearCanvas()
+	hub.placementLog.recordReset(time.Now().UnixMilli())
+	slog.Warn("canvas reset by admin", "remote_ip", remoteIP(r))
+
+	hub.broadcast <- OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeCanvasReset}}
+	w.WriteHeader(http.StatusOK)
+}
+
+// fillRequest is the JSON body of /admin/fill. The rectangle is inclusive of
+// both corners.
+type fillRequest struct {
+	Panel int `json:"panel"`
+	X0    int `json:"x0"`
+	Y0    int `json:"y0"`
+	X1    int `json:"x1"`
+	Y1    int `json:"y1"`
+	R     int `json:"r"`
+	G     int `json:"g"`
+	B     int `json:"b"`
+}
+
+// serveAdminFill paints a rectangle of one panel with a single color,
+// records it in the history with addBulk and broadcasts the change as one
+// batched update.
+func serveAdminFill(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var req fillRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Panel < 0 || req.Panel >= numPanels {
+		http.Error(w, "Panel out of range", http.StatusBadRequest)
+		return
+	}
+	if req.X0 < 0 || req.Y0 < 0 || req.X1 >= panelSize || req.Y1 >= panelSize {
+		http.Error(w, "Coordinates out of range", http.StatusBadRequest)
+		return
+	}
+	if req.X0 > req.X1 || req.Y0 > req.Y1 {
+		http.Error(w, "Inverted rectangle", http.StatusBadRequest)
+		return
+	}
+	for _, v := range []int{req.R, req.G, req.B} {
+		if v < 0 || v > 255 {
+			http.Error(w, "Color component out of range", http.StatusBadRequest)
+			return
+		}
+	}
+	rVal, gVal, bVal := byte(req.R), byte(req.G), byte(req.B)
+
+	entries := make([]byte, 0, (req.X1-req.X0+1)*(req.Y1-req.Y0+1)*4)
+	var placed []placement
+	now := time.Now().UnixMilli()
+	panelLocks[req.Panel].Lock()
+	for y := req.Y0; y <= req.Y1; y++ {
+		for x := req.X0; x <= req.X1; x++ {
+			setPixel(req.Panel, x, y, rVal, gVal, bVal, 0, now)
+			entries = binary.BigEndian.AppendUint16(entries, uint16(req.Panel))
+			entries = append(entries, byte(x), byte(y))
+			placed = append(placed, placement{Panel: uint16(req.Panel), X: uint8(x), Y: uint8(y), R: rVal, G: gVal, B: bVal, Timestamp: now})
+		}
+	}
+	panelLocks[req.Panel].Unlock()
+	for _, p := range placed {
+		hub.placementLog.record(p, "")
+	}
+	if hub.history != nil {
+		hub.history.addBulk(placed, now)
+	}
+	slog.Info("region filled by admin", "remote_ip", remoteIP(r), "panel", req.Panel,
+		"x0", req.X0, "y0", req.Y0, "x1", req.X1, "y1", req.Y1)
+
+	hub.broadcastPlacement(batchBroadcastMessage(rVal, gVal, bVal, now, entries), time.Time{})
+	w.WriteHeader(http.StatusOK)
+}
+
+// maxCloseReason is the longest reason that fits in a close frame, whose
+// payload is limited to 125 bytes including the 2-byte code.
+const maxCloseReason = 123
+
+// kickRequest is the JSON body of /admin/kick.
+type kickRequest struct {
+	Session string `json:"session"`
+	Reason  string `json:"reason"`
+}
+
+// serveAdminKick disconnects the client with the given session, sending it
+// a close frame with the reason. It is a 404 if no such client is
+// connected.
+func serveAdminKick(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var req kickRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	session, ok := parseSessionID(req.Session)
+	if !ok {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "kicked by a moderator"
+	}
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	if !hub.kick(session, reason) {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	slog.Warn("client kicked by admin", "remote_ip", remoteIP(r), "session_hash", sessionHash(session), "reason", reason)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// pixelRequest is the JSON body of /api/pixel.
+type pixelRequest struct {
+	Panel int `json:"panel"`
+	X     int `json:"x"`
+	Y     int `json:"y"`
+	R     int `json:"r"`
+	G     int `json:"g"`
+	B     int `json:"b"`
+}
+
+// pixelResponse is the JSON answer of /api/pixel. Timestamp is the pixel's
+// timestamp in Unix milliseconds after the request; if Written is false, a
+// newer placement won and Timestamp is that placement's.
+type pixelResponse struct {
+	Timestamp int64 `json:"timestamp"`
+	Written   bool  `json:"written"`
+}
+
+// serveAPIPixel paints a single pixel for scripts that do not speak the
+// websocket protocol, and broadcasts it like a websocket update. The pixel
+// has no owner, like those painted by /admin/fill, and is not subject to
+// client rate limits or cooldowns; the API token is the only gate.
+func serveAPIPixel(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var req pixelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Panel < 0 || req.Panel >= numPanels {
+		http.Error(w, "Panel out of range", http.StatusBadRequest)
+		return
+	}
+	if req.X < 0 || req.X >= panelSize || req.Y < 0 || req.Y >= panelSize {
+		http.Error(w, "Coordinates out of range", http.StatusBadRequest)
+		return
+	}
+	for _, v := range []int{req.R, req.G, req.B} {
+		if v < 0 || v > 255 {
+			http.Error(w, "Color component out of range", http.StatusBadRequest)
+			return
+		}
+	}
+	if lockedPanels[req.Panel].Load() {
+		http.Error(w, "Panel is locked", http.StatusConflict)
+		return
+	}
+	rVal, gVal, bVal := hub.paintColor(byte(req.R), byte(req.G), byte(req.B))
+
+	accepted := time.Now()
+	now := accepted.UnixMilli()
+	panelLocks[req.Panel].Lock()
+	written := setPixel(req.Panel, req.X, req.Y, rVal, gVal, bVal, 0, now)
+	ts := panels[req.Panel][req.Y][req.X].Timestamp()
+	panelLocks[req.Panel].Unlock()
+
+	if written {
+		pixelUpdatesTotal.Inc()
+		hub.activity.record(req.Panel, 1)
+		p := placement{Panel: uint16(req.Panel), X: uint8(req.X), Y: uint8(req.Y), R: rVal, G: gVal, B: bVal, Timestamp: now}
+		if hub.history != nil {
+			hub.history.add(p)
+		}
+		hub.placementLog.record(p, "")
+		slog.Debug("pixel placed over API", "remote_ip", remoteIP(r), "panel", req.Panel, "x", req.X, "y", req.Y)
+		hub.broadcastPlacement(broadcastMessage(req.Panel, req.X, req.Y, rVal, gVal, bVal, now), accepted)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(pixelResponse{Timestamp: ts, Written: written})
+}
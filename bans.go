@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ban kinds. A ban matches either the remote IP of a connection or the
+// session it tries to resume.
+const (
+	banIP      = "ip"
+	banSession = "session"
+)
+
+type banKey struct {
+	kind, value string
+}
+
+// ban is one entry of the ban list, as listed by /admin/bans and stored in
+// the ban file. A nil Expires never expires.
+type ban struct {
+	Kind    string     `json:"kind"`
+	Value   string     `json:"value"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func newBan(k banKey, expires time.Time) ban {
+	b := ban{Kind: k.kind, Value: k.value}
+	if !expires.IsZero() {
+		b.Expires = &expires
+	}
+	return b
+}
+
+// banList is the set of banned IPs and sessions consulted by serveWs. It is
+// read on every connect, so lookups only take a read lock; expired bans are
+// ignored on lookup and dropped on the next change. If path is set, the list
+// is persisted there after every change.
+type banList struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[banKey]time.Time
+}
+
+func newBanList() *banList {
+	return &banList{entries: make(map[banKey]time.Time)}
+}
+
+// loadBanList reads the bans persisted in path, which is created on the
+// first change if it does not exist yet.
+func loadBanList(path string) (*banList, error) {
+	b := newBanList()
+	b.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, e := range bans {
+		switch {
+		case e.Expires == nil:
+			b.entries[banKey{e.Kind, e.Value}] = time.Time{}
+		case e.Expires.After(now):
+			b.entries[banKey{e.Kind, e.Value}] = *e.Expires
+		}
+	}
+	return b, nil
+}
+
+// canonicalIP parses a single IP address, without zone, and returns it in
+// the form IP bans are stored and looked up in, so that e.g. an IPv4-mapped
+// IPv6 address matches a ban of the plain IPv4 address. CIDR prefixes and
+// bracketed or ported addresses are rejected.
+func canonicalIP(s string) (string, bool) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil || addr.Zone() != "" {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
+
+// banned reports whether a connection from ip, resuming session (empty if
+// none), is banned.
+func (b *banList) banned(ip, session string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.entries) == 0 {
+		return false
+	}
+	if canonical, ok := canonicalIP(ip); ok {
+		ip = canonical
+	}
+	now := time.Now()
+	for _, k := range []banKey{{banIP, ip}, {banSession, session}} {
+		if k.value == "" {
+			continue
+		}
+		if expires, ok := b.entries[k]; ok && (expires.IsZero() || expires.After(now)) {
+			return true
+		}
+	}
+	return false
+}
+
+// add bans value for d, or forever if d is zero.
+func (b *banList) add(kind, value string, d time.Duration) error {
+	var expires time.Time
+	if d > 0 {
+		expires = time.Now().Add(d)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[banKey{kind, value}] = expires
+	return b.saveLocked()
+}
+
+// remove lifts a ban. It reports whether the ban existed.
+func (b *banList) remove(kind, value string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	k := banKey{kind, value}
+	if _, ok := b.entries[k]; !ok {
+		return false, nil
+	}
+	delete(b.entries, k)
+	return true, b.saveLocked()
+}
+
+// list returns the active bans, sorted by kind and value.
+func (b *banList) list() []ban {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	now := time.Now()
+	bans := []ban{}
+	for k, expires := range b.entries {
+		if expires.IsZero() || expires.After(now) {
+			bans = append(bans, newBan(k, expires))
+		}
+	}
+	sortBans(bans)
+	return bans
+}
+
+func sortBans(bans []ban) {
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Kind != bans[j].Kind {
+			return bans[i].Kind < bans[j].Kind
+		}
+		return bans[i].Value < bans[j].Value
+	})
+}
+
+// saveLocked drops expired bans and persists the rest. The caller must hold
+// the write lock.
+func (b *banList) saveLocked() error {
+	now := time.Now()
+	bans := []ban{}
+	for k, expires := range b.entries {
+		if !expires.IsZero() && !expires.After(now) {
+			delete(b.entries, k)
+			continue
+		}
+		bans = append(bans, newBan(k, expires))
+	}
+	if b.path == "" {
+		return nil
+	}
+	sortBans(bans)
+	return writeFileAtomic(b.path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(bans)
+	})
+}
+
+// banRequest is the JSON body of /admin/ban and /admin/unban. Exactly one of
+// IP and Session must be set. Duration, e.g. "24h", only applies to
+// /admin/ban; empty uses the server's default ban duration.
+type banRequest struct {
+	IP       string `json:"ip"`
+	Session  string `json:"session"`
+	Duration string `json:"duration"`
+}
+
+// decodeBanRequest parses a ban request body into the kind and value of
+// the ban, answering the request itself on failure.
+func decodeBanRequest(w http.ResponseWriter, r *http.Request) (req banRequest, kind, value string, ok bool) {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return req, "", "", false
+	}
+	switch {
+	case req.IP != "" && req.Session == "":
+		ip, valid := canonicalIP(req.IP)
+		if !valid {
+			http.Error(w, "Invalid ip: a single address is required", http.StatusBadRequest)
+			return req, "", "", false
+		}
+		return req, banIP, ip, true
+	case req.Session != "" && req.IP == "":
+		id, valid := parseSessionID(req.Session)
+		if !valid {
+			http.Error(w, "Invalid session", http.StatusBadRequest)
+			return req, "", "", false
+		}
+		return req, banSession, id.String(), true
+	}
+	http.Error(w, "Exactly one of ip and session is required", http.StatusBadRequest)
+	return req, "", "", false
+}
+
+// banLogValue returns the value of a ban as it should be logged: session
+// IDs are bearer tokens, so session bans are logged by sessionHash.
+func banLogValue(kind, value string) string {
+	if kind == banSession {
+		if id, ok := parseSessionID(value); ok {
+			return sessionHash(id)
+		}
+	}
+	return value
+}
+
+// serveAdminBan bans an IP or session from connecting. Clients already
+// connected are not affected; use /admin/kick for them.
+func serveAdminBan(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	req, kind, value, ok := decodeBanRequest(w, r)
+	if !ok {
+		return
+	}
+	d := hub.banDuration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil || d < 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := hub.bans.add(kind, value, d); err != nil {
+		slog.Error("saving ban list", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	slog.Warn("ban added by admin", "remote_ip", remoteIP(r), "kind", kind, "value", banLogValue(kind, value), "duration", d)
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveAdminUnban lifts a ban. It is a 404 if there is no such ban.
+func serveAdminUnban(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	_, kind, value, ok := decodeBanRequest(w, r)
+	if !ok {
+		return
+	}
+	found, err := hub.bans.remove(kind, value)
+	if err != nil {
+		slog.Error("saving ban list", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "No such ban", http.StatusNotFound)
+		return
+	}
+	slog.Warn("ban lifted by admin", "remote_ip", remoteIP(r), "kind", kind, "value", banLogValue(kind, value))
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveAdminBans lists the active bans.
+func serveAdminBans(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(hub.bans.list())
+}
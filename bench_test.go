@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// benchPanelRGB returns the RGB data of a panel of panelSize×panelSize
+// pixels in which the given fraction of pixels is painted with random
+// palette colors and the rest is background.
+func benchPanelRGB(painted float64) []byte {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, panelSize*panelSize*3)
+	for i := 0; i < len(data); i += 3 {
+		c := [3]byte{background.R, background.G, background.B}
+		if rng.Float64() < painted {
+			p := palette[rng.Intn(len(palette))]
+			c = [3]byte{p.R, p.G, p.B}
+		}
+		copy(data[i:], c[:])
+	}
+	return data
+}
+
+// benchPanels are the panel contents the compression benchmarks run on.
+var benchPanels = []struct {
+	name    string
+	painted float64
+}{
+	{"sparse", 0.1},
+	{"busy", 1},
+}
+
+func BenchmarkPanelSyncCompression(b *testing.B) {
+	defer func(level int) { compressionLevel = level }(compressionLevel)
+	levels := []int{zlib.HuffmanOnly, zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression}
+	for _, panel := range benchPanels {
+		raw := benchPanelRGB(panel.painted)
+		for _, level := range levels {
+			b.Run(fmt.Sprintf("%s/level=%d", panel.name, level), func(b *testing.B) {
+				compressionLevel = level
+				b.SetBytes(int64(len(raw)))
+				var size int
+				for i := 0; i < b.N; i++ {
+					size = len(compressPanelData(raw, encodingZlib))
+				}
+				b.ReportMetric(float64(size), "compressed-bytes")
+			})
+		}
+	}
+}
+
+// discardConn is a net.Conn that drops whatever is written to it, so
+// benchmarks measure the cost of encoding frames rather than of a network.
+// It must not be read from.
+type discardConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	c.written += int64(len(p))
+	return len(p), nil
+}
+
+func (c *discardConn) Close() error                       { return nil }
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// hijackRecorder is a ResponseWriter that hands the upgrader a discardConn.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn *discardConn
+}
+
+func (h hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+// benchConn returns a server-side websocket connection whose frames are
+// discarded, and the discardConn under it. If deflate is set,
+// permessage-deflate is negotiated.
+func benchConn(b *testing.B, deflate bool) (*websocket.Conn, *discardConn) {
+	b.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Version", "13")
+	r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if deflate {
+		r.Header.Set("Sec-Websocket-Extensions", "permessage-deflate")
+	}
+	dc := &discardConn{}
+	u := websocket.Upgrader{EnableCompression: deflate}
+	conn, err := u.Upgrade(hijackRecorder{httptest.NewRecorder(), dc}, r, nil)
+	if err != nil {
+		b.Fatalf("upgrading: %v", err)
+	}
+	dc.written = 0
+	return conn, dc
+}
+
+// benchBroadcast returns a MsgTypeBroadcast message.
+func benchBroadcast() []byte {
+	return []byte{MsgTypeBroadcast, 0x00, 0x01, 2, 3, 0xff, 0x45, 0x00, 0, 0, 1, 0x90, 0, 0, 0, 0}
+}
+
+// BenchmarkBroadcastFanOut writes one broadcast to 1000 clients, as fanOut
+// and writePump do, with and without preparing it once for all of them.
+func BenchmarkBroadcastFanOut(b *testing.B) {
+	const clients = 1000
+	data := benchBroadcast()
+	for _, deflate := range []bool{false, true} {
+		conns := make([]*websocket.Conn, clients)
+		for i := range conns {
+			conns[i], _ = benchConn(b, deflate)
+		}
+		b.Run(fmt.Sprintf("deflate=%t/prepared", deflate), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, conn := range conns {
+					conn.WritePreparedMessage(pm)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("deflate=%t/unprepared", deflate), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, conn := range conns {
+					conn.WriteMessage(websocket.BinaryMessage, data)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStaticPanelSync answers repeated sync requests for a panel that
+// does not change, from the sync cache and by compressing it every time.
+func BenchmarkStaticPanelSync(b *testing.B) {
+	const panel = 15
+	rng := rand.New(rand.NewSource(1))
+	panelLocks[panel].Lock()
+	for i := 0; i < panelSize*panelSize/10; i++ {
+		p := palette[rng.Intn(len(palette))]
+		setPixel(panel, rng.Intn(panelSize), rng.Intn(panelSize), p.R, p.G, p.B, 0, time.Now().UnixMilli())
+	}
+	panelLocks[panel].Unlock()
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			compressedPanel(panel, encodingZlib)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		raw := make([]byte, panelSize*panelSize*3)
+		for i := 0; i < b.N; i++ {
+			panelLocks[panel].RLock()
+			copyPanelRGB(raw, panel)
+			panelLocks[panel].RUnlock()
+			compressPanelData(raw, encodingZlib)
+		}
+	})
+}
+
+// BenchmarkSyncEncoding compresses panels with each ?sync-encoding.
+func BenchmarkSyncEncoding(b *testing.B) {
+	encodings := []struct {
+		name     string
+		encoding byte
+	}{
+		{"zlib", encodingZlib},
+		{"gzip", encodingGzip},
+	}
+	for _, panel := range benchPanels {
+		raw := benchPanelRGB(panel.painted)
+		for _, e := range encodings {
+			b.Run(panel.name+"/"+e.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(raw)))
+				var size int
+				for i := 0; i < b.N; i++ {
+					size = len(compressPanelData(raw, e.encoding))
+				}
+				b.ReportMetric(float64(size), "compressed-bytes")
+			})
+		}
+	}
+}
+
+// BenchmarkSnapshotWriterStall composites snapshots with canvasImage while a
+// writer keeps painting one panel, and reports how long the writer waits for
+// that panel's lock.
+func BenchmarkSnapshotWriterStall(b *testing.B) {
+	const panel = 16
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var writes int
+	var total, worst time.Duration
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			start := time.Now()
+			panelLocks[panel].Lock()
+			stall := time.Since(start)
+			setPixel(panel, writes%panelSize, 0, 0xff, 0x45, 0x00, 0, time.Now().UnixMilli())
+			panelLocks[panel].Unlock()
+			writes++
+			total += stall
+			worst = max(worst, stall)
+			time.Sleep(10 * time.Microsecond)
+		}
+	}()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		canvasImage()
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+	if writes > 0 {
+		b.ReportMetric(float64(total.Nanoseconds())/float64(writes), "mean-stall-ns")
+	}
+	b.ReportMetric(float64(worst.Nanoseconds()), "max-stall-ns")
+}
+
+// BenchmarkDeflateVsManualSync sends a changed panel to 100 clients, once
+// compressed by the server and cached for all of them, and once raw over
+// permessage-deflate, which compresses it again per connection. It reports
+// the bytes written per client alongside the CPU cost.
+func BenchmarkDeflateVsManualSync(b *testing.B) {
+	const clients = 100
+	raw := benchPanelRGB(0.1)
+	for _, deflate := range []bool{false, true} {
+		conns := make([]*websocket.Conn, clients)
+		sinks := make([]*discardConn, clients)
+		for i := range conns {
+			conns[i], sinks[i] = benchConn(b, deflate)
+		}
+		name := "manual"
+		if deflate {
+			name = "permessage-deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for _, s := range sinks {
+				s.written = 0
+			}
+			for i := 0; i < b.N; i++ {
+				msg := []byte{MsgTypePanelSyncEncoded, 0x00, 0x11, encodingRaw}
+				if deflate {
+					msg = append(msg, raw...)
+				} else {
+					msg[3] = encodingZlib
+					msg = append(msg, compressPanelData(raw, encodingZlib)...)
+				}
+				for _, conn := range conns {
+					conn.WriteMessage(websocket.BinaryMessage, msg)
+				}
+			}
+			var written int64
+			for _, s := range sinks {
+				written += s.written
+			}
+			b.ReportMetric(float64(written)/float64(b.N*clients), "bytes/client")
+		})
+	}
+}
+
+// BenchmarkPlacePixelParallel paints random pixels across panels from
+// parallel goroutines, under the per-panel locks and under one global lock
+// as before they were sharded. Run it with -cpu to compare scaling. The
+// first 32 panels are left to the other tests and benchmarks.
+func BenchmarkPlacePixelParallel(b *testing.B) {
+	const firstPanel = 32
+	var global sync.Mutex
+	for _, sharded := range []bool{true, false} {
+		name := "global"
+		if sharded {
+			name = "sharded"
+		}
+		b.Run(name, func(b *testing.B) {
+			var seed atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(seed.Add(1)))
+				for pb.Next() {
+					panel := firstPanel + rng.Intn(numPanels-firstPanel)
+					x, y := rng.Intn(panelSize), rng.Intn(panelSize)
+					var mu sync.Locker = &global
+					if sharded {
+						mu = &panelLocks[panel]
+					}
+					mu.Lock()
+					setPixel(panel, x, y, 0xff, 0x45, 0x00, 0, time.Now().UnixMilli())
+					mu.Unlock()
+				}
+			})
+		})
+	}
+}
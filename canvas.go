@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// canvasPNGMaxAge is how long clients and proxies may cache /canvas.png.
+// Encoding the full canvas is expensive, so rapid refreshes are served from
+// cache instead.
+const canvasPNGMaxAge = 5 * time.Second
+
+// canvasHeaderSize is the size of the canvas.bin header: encoding (1),
+// number of panels (2), panel size (2).
+const canvasHeaderSize = 5
+
+// canvasCache holds a rendering of the whole canvas, served until the
+// canvas changes. Rendering is expensive, so flight makes concurrent
+// requests that miss the cache wait for a single build instead of each
+// rendering their own.
+type canvasCache struct {
+	mu     sync.Mutex
+	cached cachedCanvas
+	flight singleflight.Group
+}
+
+// cachedCanvas is a rendering of the canvas and the canvas generation it was
+// taken at.
+type cachedCanvas struct {
+	gen  uint64
+	data []byte
+}
+
+// canvasBinCache holds the compressed canvas.bin body of each encoding, and
+// canvasPNGCache the /canvas.png body.
+var (
+	canvasBinCache [encodingGzip + 1]canvasCache
+	canvasPNGCache canvasCache
+)
+
+// get returns the cached rendering if the canvas has not changed since, and
+// otherwise renders it with build, which must read the canvas after it is
+// called. The returned slice must not be modified.
+func (c *canvasCache) get(build func() ([]byte, error)) ([]byte, error) {
+	gen := canvasGeneration()
+	c.mu.Lock()
+	cached := c.cached
+	c.mu.Unlock()
+	if cached.data != nil && cached.gen == gen {
+		return cached.data, nil
+	}
+
+	// A build already in flight may have started before the writes this
+	// request saw; join builds until one started after them. The canvas is
+	// read after the generation, so a build holds every write counted in
+	// its generation.
+	for {
+		v, err, _ := c.flight.Do("", func() (any, error) {
+			built := cachedCanvas{gen: canvasGeneration()}
+			data, err := build()
+			if err != nil {
+				return nil, err
+			}
+			built.data = data
+			c.mu.Lock()
+			if built.gen >= c.cached.gen {
+				c.cached = built
+			}
+			c.mu.Unlock()
+			return built, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if built := v.(cachedCanvas); built.gen >= gen {
+			return built.data, nil
+		}
+	}
+}
+
+// canvasGeneration returns the sum of the panel generations, which changes
+// with every write to the canvas.
+func canvasGeneration() uint64 {
+	var gen uint64
+	for i := range panelSyncCache {
+		gen += panelSyncCache[i].gen.Load()
+	}
+	return gen
+}
+
+// writeCanvasRGB writes the RGB data of every panel, in panel order, to dst.
+// Panels are copied one at a time, each under its own read lock.
+func writeCanvasRGB(dst io.Writer) error {
+	buf := make([]byte, panelSize*panelSize*3)
+	for i := 0; i < numPanels; i++ {
+		panelLocks[i].RLock()
+		copyPanelRGB(buf, i)
+		panelLocks[i].RUnlock()
+		if _, err := dst.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressedCanvas returns the RGB data of the whole canvas compressed with
+// encoding (encodingZlib or encodingGzip), from canvasBinCache when
+// possible. The returned slice must not be modified.
+func compressedCanvas(encoding byte) []byte {
+	data, _ := canvasBinCache[encoding].get(func() ([]byte, error) {
+		var buf bytes.Buffer
+		zw := newCompressor(&buf, encoding)
+		writeCanvasRGB(zw)
+		zw.Close()
+		return buf.Bytes(), nil
+	})
+	return data
+}
+
+// serveCanvasBin streams the RGB data of every panel in panel order, so a
+// client can load the whole canvas in one request instead of issuing one
+// MsgTypeRequest per panel. The body is zlib-compressed unless the request
+// has ?encoding=raw or ?encoding=gzip.
+func serveCanvasBin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	encoding := byte(encodingZlib)
+	if name := r.URL.Query().Get("encoding"); name != "" {
+		var ok bool
+		if encoding, ok = parseEncoding(name); !ok {
+			http.Error(w, "Unknown encoding", http.StatusBadRequest)
+			return
+		}
+	}
+
+	header := make([]byte, canvasHeaderSize)
+	header[0] = encoding
+	binary.BigEndian.PutUint16(header[1:3], uint16(numPanels))
+	binary.BigEndian.PutUint16(header[3:5], uint16(panelSize))
+
+	// Raw bodies are streamed panel by panel rather than built in memory.
+	var payload []byte
+	size := numPanels * panelSize * panelSize * 3
+	if encoding != encodingRaw {
+		payload = compressedCanvas(encoding)
+		size = len(payload)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(header)+size))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(header)
+	if encoding == encodingRaw {
+		writeCanvasRGB(w)
+		return
+	}
+	w.Write(payload)
+}
+
+// servePanelPNG renders a single panel as a PNG, served at /panel/<id>.png.
+// Unknown panels are a 404.
+func servePanelPNG(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := strings.CutSuffix(r.PathValue("file"), ".png")
+	panel, err := strconv.Atoi(id)
+	if !ok || err != nil || panel < 0 || panel >= numPanels {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, panelImage(panel)); err != nil {
+		slog.Error("encoding panel image", "panel", panel, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// serveCanvasPNG renders the live canvas as a PNG, laid out like the
+// snapshots. The PNG is cached until the canvas changes.
+func serveCanvasPNG(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := canvasPNGCache.get(func() ([]byte, error) {
+		var buf bytes.Buffer
+		err := png.Encode(&buf, canvasImage())
+		return buf.Bytes(), err
+	})
+	if err != nil {
+		slog.Error("encoding canvas image", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(canvasPNGMaxAge.Seconds())))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Chat is relayed over the control plane and never stored.
+const (
+	// maxChatLen is the maximum chat message length in characters.
+	maxChatLen = 280
+	// chatRate and chatBurst bound chat messages per client.
+	chatRate  = 0.5
+	chatBurst = 3
+)
+
+// chatMessage is the control message broadcast for each chat line.
+type chatMessage struct {
+	Type      string `json:"type"`
+	ClientID  uint32 `json:"client_id"`
+	Nickname  string `json:"nickname,omitempty"`
+	Text      string `json:"text"`
+	Timestamp int64  `json:"ts"`
+}
+
+// loadChatFilter builds a case-insensitive pattern matching any word listed
+// in path, one per line. Blank lines and lines starting with # are skipped.
+// It returns nil if the file lists no words.
+func loadChatFilter(path string) (*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		w := strings.TrimSpace(sc.Text())
+		if w == "" || strings.HasPrefix(w, "#") {
+			continue
+		}
+		words = append(words, regexp.QuoteMeta(w))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+}
+
+// sanitizeChat drops non-printable characters, turns other whitespace into
+// spaces and truncates to maxChatLen characters.
+func sanitizeChat(text string) string {
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case !unicode.IsPrint(r):
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(text))
+	for utf8.RuneCountInString(text) > maxChatLen {
+		_, size := utf8.DecodeLastRuneInString(text)
+		text = text[:len(text)-size]
+	}
+	return strings.TrimSpace(text)
+}
+
+// handleControlChat relays {"type": "chat", "text": "..."} to every client,
+// masking filtered words.
+func handleControlChat(c *Client, raw []byte) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		c.controlError("invalid chat message")
+		return
+	}
+	text := sanitizeChat(req.Text)
+	if text == "" {
+		c.controlError("empty chat message")
+		return
+	}
+	if !c.chatLimiter.Allow() {
+		slog.Debug("chat rate limit exceeded", "remote_ip", c.ip)
+		c.controlError("chat rate limit exceeded")
+		return
+	}
+	if f := c.hub.chatFilter; f != nil {
+		text = f.ReplaceAllStringFunc(text, func(w string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(w))
+		})
+	}
+
+	c.hub.mu.Lock()
+	nickname := c.nickname
+	c.hub.mu.Unlock()
+	data, _ := json.Marshal(chatMessage{
+		Type:      "chat",
+		ClientID:  c.id,
+		Nickname:  nickname,
+		Text:      text,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	c.hub.broadcast <- OutgoingMessage{messageType: websocket.TextMessage, data: data}
+}
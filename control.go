@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The websocket carries two channels. Binary frames are the pixel protocol:
+// compact fixed layouts keyed by a MsgType byte, used for everything on the
+// hot path. Text frames are a JSON control plane for rare metadata
+// operations that would be awkward to squeeze into bytes. Every control
+// message is an object with a "type" field naming its handler, e.g.
+//
+//	{"type": "report", "panel": 12, "x": 3, "y": 4, "reason": "spam"}
+//
+// Replies and server-initiated control messages are text frames in the
+// same shape. Failures are answered with {"type": "error", "error": "..."}.
+
+// controlHandlers maps a control message type to its handler, which gets
+// the whole raw message to decode as it sees fit. Handlers run on readPump.
+var controlHandlers = map[string]func(c *Client, raw []byte){
+	"chat":         handleControlChat,
+	"ping":         handleControlPing,
+	"report":       handleControlReport,
+	"set_nickname": handleControlSetNickname,
+	"subscribe":    handleControlSubscribe,
+}
+
+const (
+	// maxReportReason bounds the free text of an abuse report.
+	maxReportReason = 500
+	// reportInterval and reportBurst bound abuse reports per client, since
+	// each is logged at warn level.
+	reportInterval = 10 * time.Second
+	reportBurst    = 3
+)
+
+// handleControl dispatches a text frame to its control handler.
+func (c *Client) handleControl(raw []byte) {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		c.controlError("invalid JSON")
+		return
+	}
+	handler, ok := controlHandlers[msg.Type]
+	if !ok {
+		slog.Debug("unknown control message", "remote_ip", c.ip, "type", msg.Type)
+		c.controlError("unknown message type")
+		return
+	}
+	if c.spectator && spectatorControls[msg.Type] {
+		c.controlError("not allowed for spectators")
+		return
+	}
+	handler(c, raw)
+}
+
+// sendControl queues v as a JSON text frame.
+func (c *Client) sendControl(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("encoding control message", "err", err)
+		return
+	}
+	c.queue(OutgoingMessage{messageType: websocket.TextMessage, data: data})
+}
+
+// controlError answers a control message that could not be handled.
+func (c *Client) controlError(reason string) {
+	c.sendControl(struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}{"error", reason})
+}
+
+// handleControlPing answers {"type": "ping"} with {"type": "pong"}, letting
+// clients check the control plane end to end.
+func handleControlPing(c *Client, raw []byte) {
+	c.sendControl(struct {
+		Type string `json:"type"`
+	}{"pong"})
+}
+
+// handleControlReport logs an abuse report about a pixel for moderators.
+func handleControlReport(c *Client, raw []byte) {
+	var req struct {
+		Panel  int    `json:"panel"`
+		X      int    `json:"x"`
+		Y      int    `json:"y"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		c.controlError("invalid report")
+		return
+	}
+	if req.Panel < 0 || req.Panel >= numPanels || req.X < 0 || req.X >= panelSize || req.Y < 0 || req.Y >= panelSize {
+		c.controlError("pixel out of range")
+		return
+	}
+	if !c.reportLimiter.Allow() {
+		slog.Debug("report rate limit exceeded", "remote_ip", c.ip)
+		c.controlError("report rate limit exceeded")
+		return
+	}
+	if len(req.Reason) > maxReportReason {
+		req.Reason = req.Reason[:maxReportReason]
+	}
+	panelLocks[req.Panel].RLock()
+	owner := panels[req.Panel][req.Y][req.X].Owner
+	panelLocks[req.Panel].RUnlock()
+	slog.Warn("abuse report", "remote_ip", c.ip, "client_id", c.id, "panel", req.Panel, "x", req.X, "y", req.Y, "owner", owner, "reason", req.Reason)
+	c.sendControl(struct {
+		Type string `json:"type"`
+	}{"report_received"})
+}
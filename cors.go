@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// corsEnabled makes the HTTP API answer cross-origin requests from
+// allowedOrigins, the same origins allowed to open a websocket. It is set
+// once at startup from the -cors flag; when off, browsers only let pages
+// served from the same origin read the API.
+var corsEnabled bool
+
+// corsMaxAge is how long browsers may cache a preflight response.
+const corsMaxAge = 10 * time.Minute
+
+// originAllowed reports whether origin is in allowedOrigins.
+func originAllowed(origin string) bool {
+	return allowedOrigins["*"] || allowedOrigins[origin]
+}
+
+// withCORS wraps an API handler accepting the given comma-separated methods
+// so that, if CORS is enabled, requests from allowed origins get the CORS
+// headers and preflight OPTIONS requests are answered directly, before any
+// authorization check in next.
+func withCORS(methods string, next http.HandlerFunc) http.HandlerFunc {
+	if !corsEnabled {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !originAllowed(origin) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge/time.Second)))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The permessage-deflate extension (RFC 7692) compresses every frame, which
+// makes the protocol's own compression redundant. For clients that
+// negotiate it, the server sends broadcasts as is rather than wrapped in
+// MsgTypeCompressed, and panel syncs in MsgTypePanelSyncEncoded as raw
+// rather than in the requested encoding. The legacy MsgTypePanelSync is
+// zlib-compressed by definition and is left alone.
+//
+// The trade-off is CPU for simplicity: the manual layer compresses each
+// panel once and caches it for every client (see panel_cache.go), whereas
+// the extension compresses each frame again for each connection.
+// BenchmarkDeflateVsManualSync measures both.
+
+// offersDeflate reports whether the websocket handshake r offers
+// permessage-deflate, which gorilla/websocket accepts whenever the upgrader
+// has EnableCompression set.
+func offersDeflate(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyDeflate turns off the manual compression of a client whose
+// connection negotiated permessage-deflate.
+func (c *Client) applyDeflate() {
+	c.compress = false
+	if c.encodedSync {
+		c.syncEncoding = encodingRaw
+	}
+}
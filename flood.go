@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Flood detection complements the fixed per-client limiter: a client that
+// sustains a placement rate no human reaches is flagged, and its limiter is
+// tightened to hub.floodLimit for hub.floodPenalty. The penalty is lifted on
+// the first placement after it expires. Reconnecting does not shed it: it is
+// saved with the client's session and recorded against its IP, and a new
+// connection from either picks up what is left of it. Clients sharing the
+// IP, e.g. behind a NAT, are throttled along with it.
+
+// defaultFloodLimit is the update rate a flagged client is throttled to.
+const defaultFloodLimit rate.Limit = 2
+
+// placementWindow counts a client's placements over a sliding window of
+// one-second buckets. Only readPump touches it.
+type placementWindow struct {
+	counts []int
+	secs   []int64
+}
+
+func newPlacementWindow(window time.Duration) *placementWindow {
+	n := max(1, int((window+time.Second-1)/time.Second))
+	return &placementWindow{counts: make([]int, n), secs: make([]int64, n)}
+}
+
+// add counts n placements at now and returns the total over the window.
+func (w *placementWindow) add(now time.Time, n int) int {
+	sec := now.Unix()
+	i := int(sec % int64(len(w.counts)))
+	if w.secs[i] != sec {
+		w.secs[i] = sec
+		w.counts[i] = 0
+	}
+	w.counts[i] += n
+	total := 0
+	for j, s := range w.secs {
+		if sec-s < int64(len(w.counts)) {
+			total += w.counts[j]
+		}
+	}
+	return total
+}
+
+// recordPlacements feeds n accepted placements to flood detection. Only
+// readPump may call it.
+func (c *Client) recordPlacements(n int) {
+	h := c.hub
+	if h.floodThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	if !c.floodedUntil.IsZero() && now.After(c.floodedUntil) {
+		c.floodedUntil = time.Time{}
+		c.limiter.SetLimitAt(now, h.rateLimit)
+		c.limiter.SetBurstAt(now, h.rateBurst)
+		slog.Info("flood penalty lifted", "remote_ip", c.ip, "client_id", c.id)
+	}
+	if c.placements == nil {
+		c.placements = newPlacementWindow(h.floodWindow)
+	}
+	total := c.placements.add(now, n)
+	if !c.floodedUntil.IsZero() {
+		return
+	}
+	perSecond := float64(total) / float64(len(c.placements.counts))
+	if perSecond < h.floodThreshold {
+		return
+	}
+	c.throttle(now, now.Add(h.floodPenalty))
+	h.flagIP(c.ip, c.floodedUntil)
+	floodFlaggedTotal.Inc()
+	slog.Warn("client flagged for flooding", "remote_ip", c.ip, "client_id", c.id, "session_hash", sessionHash(c.session),
+		"rate", perSecond, "threshold", h.floodThreshold, "limit", float64(h.floodLimit), "penalty", h.floodPenalty)
+}
+
+// throttle applies the flood penalty to c until the given time. Only
+// readPump, or serveWs before the pumps start, may call it.
+func (c *Client) throttle(now, until time.Time) {
+	c.floodedUntil = until
+	c.limiter.SetLimitAt(now, c.hub.floodLimit)
+	c.limiter.SetBurstAt(now, max(1, int(c.hub.floodLimit)))
+}
+
+// flagIP records that clients from ip are throttled until the given time,
+// and forgets expired penalties.
+func (h *Hub) flagIP(ip string, until time.Time) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for other, t := range h.floodedIPs {
+		if now.After(t) {
+			delete(h.floodedIPs, other)
+		}
+	}
+	h.floodedIPs[ip] = until
+}
+
+// ipFloodedUntil returns when the flood penalty of clients from ip ends,
+// zero if there is none.
+func (h *Hub) ipFloodedUntil(ip string) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.floodedIPs[ip]
+}
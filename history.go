@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// placement is one accepted pixel update in the history. Placements are
+// attributed to the client ID rather than the session ID: the client ID
+// survives session resumption just the same, while the session ID is a
+// bearer token for resuming and must not be published.
+type placement struct {
+	Panel     uint16 `json:"panel"`
+	X         uint8  `json:"x"`
+	Y         uint8  `json:"y"`
+	R         uint8  `json:"r"`
+	G         uint8  `json:"g"`
+	B         uint8  `json:"b"`
+	Timestamp int64  `json:"ts"`
+	Owner     uint32 `json:"owner"`
+}
+
+// historyEntrySize is the size of a placement in the binary /history
+// format: panel (2), x, y, r, g, b, timestamp (8), owner (4).
+const historyEntrySize = 19
+
+// historyBuffer is a bounded ring buffer of the most recent placements.
+type historyBuffer struct {
+	mu      sync.Mutex
+	entries []placement
+	next    int
+	full    bool
+	// created is when the buffer was created, in unix ms. Placements
+	// before it, e.g. before a restart, were never buffered.
+	created int64
+	// evicted is the newest timestamp of the placements overwritten so far.
+	evicted int64
+}
+
+func newHistoryBuffer(size int) *historyBuffer {
+	return &historyBuffer{entries: make([]placement, size), created: time.Now().UnixMilli()}
+}
+
+// add records p, overwriting the oldest placement once the buffer is full.
+func (h *historyBuffer) add(p placement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.full {
+		h.evicted = max(h.evicted, h.entries[h.next].Timestamp)
+	}
+	h.entries[h.next] = p
+	h.next++
+	if h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// maxBulkHistory is the largest admin fill or import recorded pixel by pixel
+// in the history. Larger ones reset it instead of flushing out every other
+// placement, so clients resuming from before them sync their panels.
+const maxBulkHistory = 1024
+
+// addBulk records the placements of an admin fill or import, all made at
+// ts, or resets the buffer at ts if there are more than maxBulkHistory.
+func (h *historyBuffer) addBulk(ps []placement, ts int64) {
+	if len(ps) > maxBulkHistory {
+		h.reset(ts)
+		return
+	}
+	for _, p := range ps {
+		h.add(p)
+	}
+}
+
+// reset drops every buffered placement, as if the buffer had been created
+// at ts, so that resuming from before ts requires a full sync.
+func (h *historyBuffer) reset(ts int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	clear(h.entries)
+	h.next = 0
+	h.full = false
+	h.created = ts
+	h.evicted = 0
+}
+
+// since returns the buffered placements newer than ts, oldest first.
+func (h *historyBuffer) since(ts int64) []placement {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sinceLocked(ts)
+}
+
+// sinceLocked is since for callers holding h.mu. Placements are in the order
+// they were added, which for relayed ones is not timestamp order, so it
+// checks every entry.
+func (h *historyBuffer) sinceLocked(ts int64) []placement {
+	var ordered []placement
+	if h.full {
+		ordered = append(ordered, h.entries[h.next:]...)
+	}
+	ordered = append(ordered, h.entries[:h.next]...)
+	out := []placement{}
+	for _, p := range ordered {
+		if p.Timestamp > ts {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// window returns the buffered placements newer than ts, oldest first, and
+// whether they are all the placements since ts; they are not if ts predates
+// the buffer or a placement newer than ts has been overwritten.
+func (h *historyBuffer) window(ts int64) ([]placement, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ts < h.created || h.evicted > ts {
+		return nil, false
+	}
+	return h.sinceLocked(ts), true
+}
+
+// serveHistory returns the buffered placements newer than ?since=<unix ms>
+// (default 0), oldest first. The body is JSON, or with ?format=binary a
+// count (4) followed by historyEntrySize-byte entries, all big-endian.
+func serveHistory(h *historyBuffer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h == nil {
+		http.Error(w, "History is disabled", http.StatusNotFound)
+		return
+	}
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	entries := h.since(since)
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+	case "binary":
+		buf := make([]byte, 4, 4+len(entries)*historyEntrySize)
+		binary.BigEndian.PutUint32(buf, uint32(len(entries)))
+		for _, p := range entries {
+			buf = binary.BigEndian.AppendUint16(buf, p.Panel)
+			buf = append(buf, p.X, p.Y, p.R, p.G, p.B)
+			buf = binary.BigEndian.AppendUint64(buf, uint64(p.Timestamp))
+			buf = binary.BigEndian.AppendUint32(buf, p.Owner)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write(buf)
+	default:
+		http.Error(w, "Unknown format", http.StatusBadRequest)
+	}
+}
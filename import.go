@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxImportSize bounds the PNG uploaded to /admin/import.
+const maxImportSize = 32 << 20
+
+// importPixel is a pixel of an imported image, converted and placed on its
+// panel.
+type importPixel struct {
+	x, y uint8
+	rgb  color.RGBA
+}
+
+// importResponse is the JSON answer of /admin/import.
+type importResponse struct {
+	// Pixels is the number of pixels written; transparent pixels of the
+	// image are skipped.
+	Pixels int `json:"pixels"`
+}
+
+// importOffset parses the target of an import into canvas coordinates:
+// ?x and ?y (default 0) are relative to the top-left corner of ?panel if
+// given, or of the canvas otherwise.
+func importOffset(r *http.Request) (x0, y0 int, err error) {
+	q := r.URL.Query()
+	cols, rows := gridDims()
+	// Bound each coordinate on its own first, so that adding the panel
+	// offset or the image size to it cannot overflow.
+	for _, v := range []struct {
+		name  string
+		dst   *int
+		limit int
+	}{{"x", &x0, cols * panelSize}, {"y", &y0, rows * panelSize}} {
+		if s := q.Get(v.name); s != "" {
+			if *v.dst, err = strconv.Atoi(s); err != nil || *v.dst < 0 || *v.dst >= v.limit {
+				return 0, 0, errors.New("invalid " + v.name)
+			}
+		}
+	}
+	if s := q.Get("panel"); s != "" {
+		panel, err := strconv.Atoi(s)
+		if err != nil || panel < 0 || panel >= numPanels {
+			return 0, 0, errors.New("invalid panel")
+		}
+		x0 += panel % cols * panelSize
+		y0 += panel / cols * panelSize
+	}
+	if x0 >= cols*panelSize || y0 >= rows*panelSize {
+		return 0, 0, errors.New("offset outside the canvas")
+	}
+	return x0, y0, nil
+}
+
+// serveAdminImport stamps the PNG in the request body onto the canvas at
+// the offset given by importOffset, and broadcasts the change as batched
+// updates, one per color. Colors are mapped to the nearest palette color
+// with -palette-only, or on request with ?palette=1. Pixels with less than
+// half opacity are left untouched. The image must fit within the canvas. It
+// is recorded in the history with addBulk.
+func serveAdminImport(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	x0, y0, err := importOffset(r)
+	if err != nil {
+		http.Error(w, "Invalid target: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, "Image too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Check the dimensions before decoding the whole image.
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Invalid PNG: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cols, rows := gridDims()
+	if cfg.Width > cols*panelSize-x0 || cfg.Height > rows*panelSize-y0 {
+		http.Error(w, "Image exceeds the canvas", http.StatusBadRequest)
+		return
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Invalid PNG: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	quantize := hub.paletteOnly || r.URL.Query().Get("palette") == "1"
+
+	// Decode and convert the whole image before taking any lock, then
+	// write it one panel at a time so that no panel stays locked while
+	// others are written.
+	pending := make(map[int][]importPixel)
+	var touched []int
+	b := img.Bounds()
+	for y := 0; y < cfg.Height; y++ {
+		for x := 0; x < cfg.Width; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if c.A < 0x80 {
+				continue
+			}
+			rgb := color.RGBA{c.R, c.G, c.B, 0xff}
+			if quantize {
+				rgb = nearestPaletteColor(rgb)
+			}
+			cx, cy := x0+x, y0+y
+			panel := cy/panelSize*cols + cx/panelSize
+			if panel >= numPanels {
+				continue
+			}
+			if pending[panel] == nil {
+				touched = append(touched, panel)
+			}
+			pending[panel] = append(pending[panel], importPixel{uint8(cx % panelSize), uint8(cy % panelSize), rgb})
+		}
+	}
+
+	var placed []placement
+	now := time.Now().UnixMilli()
+	for _, panel := range touched {
+		panelLocks[panel].Lock()
+		for _, p := range pending[panel] {
+			if setPixel(panel, int(p.x), int(p.y), p.rgb.R, p.rgb.G, p.rgb.B, 0, now) {
+				placed = append(placed, placement{Panel: uint16(panel), X: p.x, Y: p.y, R: p.rgb.R, G: p.rgb.G, B: p.rgb.B, Timestamp: now})
+			}
+		}
+		panelLocks[panel].Unlock()
+	}
+	written := len(placed)
+
+	// entries holds the (panel (2), x, y) records of each color.
+	entries := make(map[color.RGBA][]byte)
+	for _, p := range placed {
+		rgb := color.RGBA{p.R, p.G, p.B, 0xff}
+		e := binary.BigEndian.AppendUint16(entries[rgb], p.Panel)
+		entries[rgb] = append(e, p.X, p.Y)
+		hub.placementLog.record(p, "")
+	}
+	if hub.history != nil {
+		hub.history.addBulk(placed, now)
+	}
+	pixelUpdatesTotal.Add(float64(written))
+	slog.Info("image imported by admin", "remote_ip", remoteIP(r), "x", x0, "y", y0,
+		"width", cfg.Width, "height", cfg.Height, "pixels", written, "colors", len(entries))
+
+	// A batch broadcast counts its entries in 16 bits.
+	const maxEntries = 1<<16 - 1
+	for rgb, e := range entries {
+		for len(e) > 0 {
+			n := min(len(e), maxEntries*4)
+			hub.broadcastPlacement(batchBroadcastMessage(rgb.R, rgb.G, rgb.B, now, e[:n]), time.Time{})
+			e = e[n:]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(importResponse{Pixels: written})
+}
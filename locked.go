@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Locked panels are read-only for clients, e.g. to protect finished art.
+// Admins lock and unlock them; admin fills still apply. The set is saved to
+// the snapshot store's locked panels sidecar on every change, so it
+// survives restarts unless persistence is disabled.
+
+// updatePanelLocked is the MsgTypeUpdateAck result for an update to a
+// locked panel.
+const updatePanelLocked = 3
+
+// lockedPanels flags the locked panels. allocateCanvas sizes it.
+var lockedPanels []atomic.Bool
+
+// lockedPanelsMu serializes changes to lockedPanels with saving them.
+var lockedPanelsMu sync.Mutex
+
+// panelLockedMessage builds a MsgTypePanelLocked message.
+func panelLockedMessage(panel int, locked bool) []byte {
+	msg := []byte{MsgTypePanelLocked, byte(panel >> 8), byte(panel), 0}
+	if locked {
+		msg[3] = 1
+	}
+	return msg
+}
+
+// listLockedPanels returns the locked panels in ascending order.
+func listLockedPanels() []int {
+	locked := []int{}
+	for i := range lockedPanels {
+		if lockedPanels[i].Load() {
+			locked = append(locked, i)
+		}
+	}
+	return locked
+}
+
+// loadLockedPanels restores the locked panels saved in store.
+func loadLockedPanels(store SnapshotStore) error {
+	sidecar, err := store.LoadLockedPanels()
+	if errors.Is(err, errNoSnapshot) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var locked []int
+	if err := json.Unmarshal(sidecar, &locked); err != nil {
+		return err
+	}
+	for _, p := range locked {
+		if p >= 0 && p < numPanels {
+			lockedPanels[p].Store(true)
+		}
+	}
+	return nil
+}
+
+// unlocked reports whether panel accepts updates from c, answering the
+// update with a MsgTypeUpdateAck carrying updatePanelLocked if not.
+func (c *Client) unlocked(panel int) bool {
+	if !lockedPanels[panel].Load() {
+		return true
+	}
+	slog.Debug("update to locked panel", "remote_ip", c.ip, "panel", panel)
+	c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUpdateAck, updatePanelLocked}})
+	return false
+}
+
+// queueSync queues the sync of panel, preceded by a MsgTypePanelLocked if
+// the panel is locked.
+func (c *Client) queueSync(panel int) {
+	if lockedPanels[panel].Load() {
+		c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: panelLockedMessage(panel, true)})
+	}
+	c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: c.syncMessage(panel)})
+}
+
+// lockRequest is the JSON body of /admin/lock and /admin/unlock.
+type lockRequest struct {
+	Panels []int `json:"panels"`
+}
+
+// serveAdminLock locks or unlocks panels, saves the new set to store (nil
+// if persistence is disabled) and tells connected clients about each panel
+// whose state changed.
+func serveAdminLock(hub *Hub, store SnapshotStore, locked bool, w http.ResponseWriter, r *http.Request) {
+	var req lockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, p := range req.Panels {
+		if p < 0 || p >= numPanels {
+			http.Error(w, "Panel out of range", http.StatusBadRequest)
+			return
+		}
+	}
+
+	lockedPanelsMu.Lock()
+	var changed []int
+	for _, p := range req.Panels {
+		if lockedPanels[p].Swap(locked) != locked {
+			changed = append(changed, p)
+		}
+	}
+	var err error
+	if store != nil && len(changed) > 0 {
+		var sidecar []byte
+		if sidecar, err = json.Marshal(listLockedPanels()); err == nil {
+			err = store.SaveLockedPanels(sidecar)
+		}
+	}
+	lockedPanelsMu.Unlock()
+	if err != nil {
+		// The change stands in memory; it is lost on restart.
+		slog.Error("saving locked panels", "err", err)
+	}
+
+	slog.Warn("panel locks changed by admin", "remote_ip", remoteIP(r), "locked", locked, "panels", changed)
+	for _, p := range changed {
+		hub.broadcast <- OutgoingMessage{messageType: websocket.BinaryMessage, data: panelLockedMessage(p, locked)}
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveAdminLocks lists the locked panels.
+func serveAdminLocks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(listLockedPanels())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics exposed on /metrics.
+var (
+	pixelUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_pixel_updates_total",
+		Help: "Total number of pixel updates processed.",
+	})
+	broadcastsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_broadcasts_total",
+		Help: "Total number of messages broadcast to clients.",
+	})
+	droppedMessagesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_dropped_messages_total",
+		Help: "Total number of messages dropped because a client was too slow.",
+	})
+	sendOverflowsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_send_queue_overflows_total",
+		Help: "Total number of times a broadcast found a client's send queue full.",
+	})
+	shedBroadcastsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_shed_broadcasts_total",
+		Help: "Total number of superseded pixel broadcasts dropped while the hub was overloaded.",
+	})
+	broadcastQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gows_broadcast_queue_depth",
+		Help: "Number of broadcasts waiting for the hub to fan them out.",
+	})
+	broadcastLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gows_broadcast_latency_seconds",
+		Help:    "Time from accepting a pixel update to queueing its broadcast for every client.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	globalRateLimitedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_global_rate_limited_total",
+		Help: "Total number of updates rejected by the server-wide rate limit.",
+	})
+	floodFlaggedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_flood_flagged_total",
+		Help: "Total number of clients flagged and throttled by flood detection.",
+	})
+	writeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gows_write_duration_seconds",
+		Help:    "Time taken to write a frame to a client connection.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	slowWriteDisconnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_slow_write_disconnects_total",
+		Help: "Total number of clients disconnected after repeated slow writes.",
+	})
+	abnormalDisconnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_abnormal_disconnects_total",
+		Help: "Total number of client connections lost without a normal websocket close.",
+	})
+	connectionsRejectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_connections_rejected_total",
+		Help: "Total number of websocket connections rejected by the connection cap.",
+	})
+	idleDisconnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_idle_disconnects_total",
+		Help: "Total number of clients disconnected for sending nothing within the idle timeout.",
+	})
+	relayedUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_relayed_updates_total",
+		Help: "Total number of pixel updates applied from other instances.",
+	})
+	relayDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_relay_dropped_total",
+		Help: "Total number of placements that could not be relayed to other instances.",
+	})
+	relayDuplicatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_relay_duplicates_total",
+		Help: "Total number of relayed placements dropped as duplicates.",
+	})
+	placementLogDroppedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gows_placement_log_dropped_total",
+		Help: "Total number of placements that could not be written to the database.",
+	})
+	snapshotFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gows_snapshot_failures",
+		Help: "Number of consecutive failed snapshots; zero when snapshots are healthy.",
+	})
+	pingRTT = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gows_ping_rtt_seconds",
+		Help:    "Round-trip time of websocket pings to clients.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 10),
+	})
+	connectedClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gows_connected_clients",
+		Help: "Number of currently connected websocket clients.",
+	})
+)
+
+// registerMetrics registers the server's metrics with reg.
+func registerMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		pixelUpdatesTotal,
+		broadcastsTotal,
+		droppedMessagesTotal,
+		sendOverflowsTotal,
+		shedBroadcastsTotal,
+		broadcastQueueDepth,
+		broadcastLatency,
+		globalRateLimitedTotal,
+		floodFlaggedTotal,
+		writeDuration,
+		slowWriteDisconnectsTotal,
+		abnormalDisconnectsTotal,
+		connectionsRejectedTotal,
+		idleDisconnectsTotal,
+		relayedUpdatesTotal,
+		relayDroppedTotal,
+		relayDuplicatesTotal,
+		placementLogDroppedTotal,
+		snapshotFailures,
+		pingRTT,
+		connectedClients,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
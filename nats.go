@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsRelay relays placements through a NATS subject. The NATS client
+// buffers publishes and reconnects by itself; placements published while it
+// is disconnected are buffered up to its reconnect buffer and dropped beyond.
+type natsRelay struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// newNATSRelay connects to the NATS servers at url, a comma-separated list
+// such as nats://host:4222, to relay placements on subject.
+func newNATSRelay(url, subject string) (*natsRelay, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("gows "+instanceID.String()),
+		nats.Timeout(10*time.Second),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("disconnected from nats", "err", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("reconnected to nats", "server", c.ConnectedUrlRedacted())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsRelay{conn: conn, subject: subject}, nil
+}
+
+func (r *natsRelay) publish(payload []byte) {
+	if err := r.conn.Publish(r.subject, payload); err != nil {
+		relayDroppedTotal.Inc()
+		slog.Debug("publishing placement to nats", "err", err)
+	}
+}
+
+// subscribe applies the placements published by other instances. apply runs
+// on the subscription's goroutine, one message at a time.
+func (r *natsRelay) subscribe(apply func(payload []byte)) error {
+	_, err := r.conn.Subscribe(r.subject, func(msg *nats.Msg) {
+		apply(msg.Data)
+	})
+	return err
+}
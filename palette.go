@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// palette is the fixed set of colors clients may paint with using
+// MsgTypeUpdatePalette, and the only ones with -palette-only. Indices are part
+// of the wire protocol, so only append.
+var palette = []color.RGBA{
+	{0x00, 0x00, 0x00, 0xff}, // black
+	{0x22, 0x22, 0x22, 0xff},
+	{0x55, 0x55, 0x55, 0xff},
+	{0x88, 0x88, 0x88, 0xff},
+	{0xbb, 0xbb, 0xbb, 0xff},
+	{0xff, 0xff, 0xff, 0xff}, // white
+	{0x6d, 0x00, 0x1a, 0xff},
+	{0xbe, 0x00, 0x39, 0xff},
+	{0xff, 0x45, 0x00, 0xff},
+	{0xff, 0xa8, 0x00, 0xff},
+	{0xff, 0xd6, 0x35, 0xff},
+	{0xff, 0xf8, 0xb8, 0xff},
+	{0x00, 0xa3, 0x68, 0xff},
+	{0x00, 0xcc, 0x78, 0xff},
+	{0x7e, 0xed, 0x56, 0xff},
+	{0x00, 0x75, 0x6f, 0xff},
+	{0x00, 0x9e, 0xaa, 0xff},
+	{0x00, 0xcc, 0xc0, 0xff},
+	{0x24, 0x50, 0xa4, 0xff},
+	{0x36, 0x90, 0xea, 0xff},
+	{0x51, 0xe9, 0xf4, 0xff},
+	{0x49, 0x3a, 0xc1, 0xff},
+	{0x6a, 0x5c, 0xff, 0xff},
+	{0x94, 0xb3, 0xff, 0xff},
+	{0x81, 0x1e, 0x9f, 0xff},
+	{0xb4, 0x4a, 0xc0, 0xff},
+	{0xe4, 0xab, 0xff, 0xff},
+	{0xde, 0x10, 0x7f, 0xff},
+	{0xff, 0x38, 0x81, 0xff},
+	{0xff, 0x99, 0xaa, 0xff},
+	{0x6d, 0x48, 0x2f, 0xff},
+	{0x9c, 0x69, 0x26, 0xff},
+}
+
+// paletteMessage encodes the palette as a MsgTypePalette message.
+func paletteMessage() []byte {
+	msg := make([]byte, 2, 2+len(palette)*3)
+	msg[0] = MsgTypePalette
+	msg[1] = byte(len(palette))
+	for _, c := range palette {
+		msg = append(msg, c.R, c.G, c.B)
+	}
+	return msg
+}
+
+// nearestPaletteColor returns the palette color closest to c.
+func nearestPaletteColor(c color.RGBA) color.RGBA {
+	best, bestDist := palette[0], -1
+	for _, p := range palette {
+		dr, dg, db := int(c.R)-int(p.R), int(c.G)-int(p.G), int(c.B)-int(p.B)
+		if d := dr*dr + dg*dg + db*db; bestDist < 0 || d < bestDist {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
+
+// paintColor returns the color a client asking for r, g, b paints with: the
+// color itself, or the nearest palette color with -palette-only.
+func (h *Hub) paintColor(r, g, b byte) (byte, byte, byte) {
+	if !h.paletteOnly {
+		return r, g, b
+	}
+	c := nearestPaletteColor(color.RGBA{r, g, b, 0xff})
+	return c.R, c.G, c.B
+}
+
+// colorBounds constrains the colors randomly assigned to new clients, so that
+// none is too dark or too grey to tell apart from the empty canvas. Clients
+// may still pick any color with MsgTypeSetColor, unless -palette-only snaps
+// it, and the assigned one, to the palette.
+type colorBounds struct {
+	// minLuma is the minimum Rec. 601 luma, from 0 (black) to 1 (white).
+	minLuma float64
+	// minSaturation is the minimum HSV saturation, from 0 (grey) to 1.
+	minSaturation float64
+}
+
+// defaultMinColorLuma keeps assigned colors clear of near-black.
+const defaultMinColorLuma = 0.2
+
+// colorTries bounds the rejection sampling in colorBounds.random.
+const colorTries = 64
+
+// luma returns the Rec. 601 luma of an sRGB color, from 0 to 1.
+func luma(r, g, b byte) float64 {
+	return (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 255
+}
+
+// saturation returns the HSV saturation of a color, from 0 to 1.
+func saturation(r, g, b byte) float64 {
+	hi, lo := max(r, g, b), min(r, g, b)
+	if hi == 0 {
+		return 0
+	}
+	return float64(hi-lo) / float64(hi)
+}
+
+// random returns a random color within the bounds, drawing channels from
+// intn, which is rand.Intn outside of tests. If no draw satisfies both bounds
+// within colorTries, the last one is blended towards white until it is bright
+// enough, so the luma bound always holds even if the saturation bound
+// cannot.
+func (cb colorBounds) random(intn func(n int) int) (r, g, b byte) {
+	for range colorTries {
+		r, g, b = byte(intn(256)), byte(intn(256)), byte(intn(256))
+		if luma(r, g, b) >= cb.minLuma && saturation(r, g, b) >= cb.minSaturation {
+			return r, g, b
+		}
+	}
+	l := luma(r, g, b)
+	if l >= cb.minLuma {
+		return r, g, b
+	}
+	t := (cb.minLuma - l) / (1 - l)
+	lift := func(c byte) byte {
+		return byte(min(255, math.Ceil(float64(c)+t*float64(255-c))))
+	}
+	return lift(r), lift(g), lift(b)
+}
+
+// parseHexColor parses an RGB color written as "#rrggbb" or "rrggbb".
+func parseHexColor(s string) (color.RGBA, bool) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "#"))
+	if err != nil || len(b) != 3 {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{b[0], b[1], b[2], 0xff}, true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// panelSyncCache holds the compressed RGB data of each panel so repeated
+// sync requests for an unchanged panel skip compression entirely. Each panel
+// has its own slot, so writers to different panels never contend on the
+// cache, and a write only bumps an atomic generation: it never takes a lock
+// beyond the panel's own. allocateCanvas sizes it.
+var panelSyncCache []panelCache
+
+// panelCache is the sync cache slot of one panel.
+type panelCache struct {
+	// gen counts writes to the panel. Writers bump it while holding the
+	// panel's write lock, so it is stable under the read lock. It doubles as
+	// the panel version sent to clients, see panelVersion.
+	gen atomic.Uint64
+	// mu guards data, the compressed data indexed by encoding. An entry is
+	// only valid while its generation is current; stale ones are replaced
+	// on the next request.
+	mu   sync.Mutex
+	data [encodingGzip + 1]cachedPanelData
+}
+
+// cachedPanelData is compressed panel data and the generation it was taken
+// at.
+type cachedPanelData struct {
+	gen  uint64
+	data []byte
+}
+
+// panelVersion returns the current version of panel, which changes with
+// every write to it. Clients caching panels send it back in a
+// MsgTypeVersionedRequest to skip the sync if their copy is current.
+func panelVersion(panel int) uint64 {
+	return panelSyncCache[panel].gen.Load()
+}
+
+// panelVersionMessage builds a MsgTypePanelVersion message.
+func panelVersionMessage(panel int, version uint64, unchanged bool) []byte {
+	msg := make([]byte, 12)
+	msg[0] = MsgTypePanelVersion
+	binary.BigEndian.PutUint16(msg[1:3], uint16(panel))
+	binary.BigEndian.PutUint64(msg[3:11], version)
+	if unchanged {
+		msg[11] = 1
+	}
+	return msg
+}
+
+// compressedPanel returns the RGB data of panel compressed with encoding
+// (encodingZlib or encodingGzip), from the cache when possible. The
+// returned slice must not be modified.
+func compressedPanel(panel int, encoding byte) []byte {
+	e := &panelSyncCache[panel]
+	gen := e.gen.Load()
+	e.mu.Lock()
+	cached := e.data[encoding]
+	e.mu.Unlock()
+	if cached.data != nil && cached.gen == gen {
+		return cached.data
+	}
+
+	rawData := make([]byte, panelSize*panelSize*3)
+	panelLocks[panel].RLock()
+	gen = e.gen.Load()
+	copyPanelRGB(rawData, panel)
+	panelLocks[panel].RUnlock()
+	data := compressPanelData(rawData, encoding)
+
+	e.mu.Lock()
+	// A concurrent request may have stored a newer copy meanwhile.
+	if gen >= e.data[encoding].gen {
+		e.data[encoding] = cachedPanelData{gen: gen, data: data}
+	}
+	e.mu.Unlock()
+	return data
+}
+
+// invalidatePanel drops the cached data of panel. Writers call it after
+// changing a pixel, while still holding the panel's write lock.
+func invalidatePanel(panel int) {
+	panelSyncCache[panel].gen.Add(1)
+}
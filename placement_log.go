@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// placementLogBuffer is the number of placements waiting to be written
+	// to the database before new ones are dropped.
+	placementLogBuffer = 65536
+	// placementLogBatch is the most placements written in one COPY.
+	placementLogBatch = 4096
+	// placementLogFlush is how long a placement may wait for a batch to
+	// fill before it is written anyway.
+	placementLogFlush = time.Second
+	// placementLogReplayMargin is how far before the newest pixel of the
+	// loaded snapshot the log is replayed, to cover placements the snapshot
+	// missed while it was being taken.
+	placementLogReplayMargin = time.Minute
+)
+
+// placementLogSchema creates the placements table if needed. Sessions are
+// stored as sessionHash, like in the access log, since session IDs are
+// bearer tokens. A canvas reset is logged as a row with panel
+// placementLogReset and zero coordinates and color, so that replaying the
+// log clears the canvas at the same point.
+const placementLogSchema = `CREATE TABLE IF NOT EXISTS placements (
+	id           bigserial PRIMARY KEY,
+	panel        integer   NOT NULL,
+	x            smallint  NOT NULL,
+	y            smallint  NOT NULL,
+	r            smallint  NOT NULL,
+	g            smallint  NOT NULL,
+	b            smallint  NOT NULL,
+	ts           bigint    NOT NULL,
+	owner        bigint    NOT NULL,
+	session_hash text
+);
+CREATE INDEX IF NOT EXISTS placements_ts ON placements (ts)`
+
+var placementLogColumns = []string{"panel", "x", "y", "r", "g", "b", "ts", "owner", "session_hash"}
+
+// placementLogReset is the panel of the rows marking canvas resets.
+const placementLogReset = -1
+
+// loggedPlacement is a placement waiting to be written, with the hash of the
+// placing client's session, empty for placements made over the HTTP API. If
+// reset is set it marks a canvas reset at the placement's timestamp instead.
+type loggedPlacement struct {
+	placement
+	sessionHash string
+	reset       bool
+}
+
+// placementLog appends every placement to a PostgreSQL table, for durable
+// and queryable history. Placements are queued on a buffered channel and
+// written in batches by a single goroutine, so the hot path never waits for
+// the database; if it falls behind or fails, placements are dropped and
+// counted rather than blocking clients. A nil *placementLog logs nothing.
+type placementLog struct {
+	pool *pgxpool.Pool
+	in   chan loggedPlacement
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newPlacementLog connects to the database at url and creates the
+// placements table if needed.
+func newPlacementLog(ctx context.Context, url string) (*placementLog, error) {
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, placementLogSchema); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	l := &placementLog{
+		pool: pool,
+		in:   make(chan loggedPlacement, placementLogBuffer),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// record queues p for writing. sessionHash identifies the placing client's
+// session, as returned by sessionHash, and is empty for placements made over
+// the HTTP API.
+func (l *placementLog) record(p placement, sessionHash string) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.in <- loggedPlacement{placement: p, sessionHash: sessionHash}:
+	default:
+		placementLogDroppedTotal.Inc()
+	}
+}
+
+// recordReset queues a marker for a canvas reset at ts. Unlike placements it
+// is never dropped for lack of room, since replaying past a lost marker
+// would bring back every pixel painted before the reset.
+func (l *placementLog) recordReset(ts int64) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.in <- loggedPlacement{placement: placement{Timestamp: ts}, reset: true}:
+	case <-l.stop:
+	}
+}
+
+func (l *placementLog) run() {
+	defer close(l.done)
+	batch := make([]loggedPlacement, 0, placementLogBatch)
+	timer := time.NewTimer(placementLogFlush)
+	defer timer.Stop()
+	for {
+		select {
+		case <-l.stop:
+			// Drain what was queued before close; later placements
+			// stay in the channel.
+			for len(l.in) > 0 {
+				batch = append(batch, <-l.in)
+			}
+			l.write(batch)
+			return
+		case p := <-l.in:
+			batch = append(batch, p)
+			if len(batch) < placementLogBatch {
+				continue
+			}
+		case <-timer.C:
+		}
+		l.write(batch)
+		batch = batch[:0]
+		timer.Reset(placementLogFlush)
+	}
+}
+
+// write inserts batch with a single COPY.
+func (l *placementLog) write(batch []loggedPlacement) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := l.pool.CopyFrom(ctx, pgx.Identifier{"placements"}, placementLogColumns,
+		pgx.CopyFromSlice(len(batch), func(i int) ([]any, error) {
+			p := batch[i]
+			panel := int32(p.Panel)
+			if p.reset {
+				panel = placementLogReset
+			}
+			var session any
+			if p.sessionHash != "" {
+				session = p.sessionHash
+			}
+			return []any{panel, int16(p.X), int16(p.Y), int16(p.R), int16(p.G), int16(p.B), p.Timestamp, int64(p.Owner), session}, nil
+		}))
+	if err != nil {
+		placementLogDroppedTotal.Add(float64(len(batch)))
+		slog.Error("writing placements to database", "placements", len(batch), "err", err)
+	}
+}
+
+// close writes the queued placements and disconnects. Placements recorded
+// afterwards are never written.
+func (l *placementLog) close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.pool.Close()
+}
+
+// replay applies the logged placements newer than since, in Unix
+// milliseconds, to the canvas, and returns how many it read. Placements
+// older than the pixels they land on are ignored (last write wins), so
+// replaying over a snapshot only adds what the snapshot missed. A logged
+// reset clears the canvas, so pixels painted before it never come back,
+// even from a snapshot taken before it.
+func (l *placementLog) replay(ctx context.Context, since int64) (int, error) {
+	rows, err := l.pool.Query(ctx, "SELECT panel, x, y, r, g, b, ts, owner FROM placements WHERE ts > $1 ORDER BY id", since)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var panel int32
+		var x, y, r, g, b int16
+		var ts, owner int64
+		if err := rows.Scan(&panel, &x, &y, &r, &g, &b, &ts, &owner); err != nil {
+			return n, err
+		}
+		n++
+		if panel == placementLogReset {
+			clearCanvas()
+			continue
+		}
+		if panel < 0 || int(panel) >= numPanels || x < 0 || int(x) >= panelSize || y < 0 || int(y) >= panelSize {
+			return n, errors.New("logged placement outside the canvas; was -panels or -panel-size changed?")
+		}
+		panelLocks[panel].Lock()
+		setPixel(int(panel), int(x), int(y), byte(r), byte(g), byte(b), uint32(owner), ts)
+		panelLocks[panel].Unlock()
+	}
+	return n, rows.Err()
+}
+
+// newestPixelTimestamp returns the newest pixel timestamp on the canvas, or
+// zero if none is known.
+func newestPixelTimestamp() int64 {
+	var newest int64
+	for i := range panels {
+		panelLocks[i].RLock()
+		for y := range panels[i] {
+			for x := range panels[i][y] {
+				newest = max(newest, panels[i][y][x].Timestamp())
+			}
+		}
+		panelLocks[i].RUnlock()
+	}
+	return newest
+}
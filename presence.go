@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxNicknameLen is the maximum nickname length in characters.
+	maxNicknameLen = 24
+	// nicknameInterval is the minimum time between two nickname changes by
+	// one client, since each is broadcast to every client.
+	nicknameInterval = 5 * time.Second
+)
+
+// sanitizeNickname strips control and other non-printable characters,
+// collapses runs of whitespace and truncates to maxNicknameLen characters.
+func sanitizeNickname(name string) string {
+	var b strings.Builder
+	n := 0
+	space := false
+	for _, r := range strings.TrimSpace(name) {
+		if n == maxNicknameLen {
+			break
+		}
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if space && n > 0 {
+			b.WriteByte(' ')
+			n++
+			if n == maxNicknameLen {
+				break
+			}
+		}
+		space = false
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// presenceEvent is the control message broadcast when a named client joins,
+// leaves or renames itself. Clients without a nickname are not announced.
+type presenceEvent struct {
+	Type     string `json:"type"`
+	Event    string `json:"event"`
+	ClientID uint32 `json:"client_id"`
+	Nickname string `json:"nickname"`
+}
+
+// presenceMessage builds a presence broadcast for client id.
+func presenceMessage(event string, id uint32, nickname string) OutgoingMessage {
+	data, _ := json.Marshal(presenceEvent{Type: "presence", Event: event, ClientID: id, Nickname: nickname})
+	return OutgoingMessage{messageType: websocket.TextMessage, data: data}
+}
+
+// handleControlSetNickname sets the client's nickname from
+// {"type": "set_nickname", "nickname": "..."} and announces it. An empty
+// nickname leaves the presence list. Changes coming faster than one per
+// nicknameInterval are refused.
+func handleControlSetNickname(c *Client, raw []byte) {
+	var req struct {
+		Nickname string `json:"nickname"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		c.controlError("invalid nickname")
+		return
+	}
+	name := sanitizeNickname(req.Nickname)
+
+	// Only readPump changes the nickname, so it cannot change in between.
+	c.hub.mu.Lock()
+	old := c.nickname
+	c.hub.mu.Unlock()
+	if name == old {
+		return
+	}
+	if !c.nicknameLimiter.Allow() {
+		slog.Debug("nickname rate limit exceeded", "remote_ip", c.ip)
+		c.controlError("nickname rate limit exceeded")
+		return
+	}
+	c.hub.mu.Lock()
+	c.nickname = name
+	c.hub.mu.Unlock()
+	slog.Info("nickname set", "remote_ip", c.ip, "client_id", c.id, "nickname", name)
+
+	event := "rename"
+	switch {
+	case old == "":
+		event = "join"
+	case name == "":
+		event = "leave"
+	}
+	c.hub.broadcast <- presenceMessage(event, c.id, name)
+}
+
+// servePresence lists the connected clients that have set a nickname.
+func servePresence(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type member struct {
+		ClientID uint32 `json:"client_id"`
+		Nickname string `json:"nickname"`
+	}
+	members := []member{}
+	hub.mu.Lock()
+	total := len(hub.clients)
+	for c := range hub.clients {
+		if c.nickname != "" {
+			members = append(members, member{c.id, c.nickname})
+		}
+	}
+	hub.mu.Unlock()
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ClientID < members[j].ClientID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Clients int      `json:"clients"`
+		Members []member `json:"members"`
+	}{total, members})
+}
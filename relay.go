@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A relay shares placements between instances of the server running behind
+// a load balancer, so clients see the same canvas whichever instance they
+// are connected to. Each instance publishes the broadcasts of placements
+// made on it, prefixed with its instanceID and a sequence number, and
+// applies those of the other instances to its own panels, broadcasting them
+// to its own clients. Pixel timestamps travel with the placements, so every
+// instance resolves conflicting placements the same way (last write wins).
+// Relayed placements are never published again, and an instance skips its
+// own, so there are no echo loops; the sequence number drops the duplicates
+// some transports deliver. Canvas resets are not relayed.
+type relay interface {
+	// publish sends payload, as built by relayPayload, to the other
+	// instances. It must not block.
+	publish(payload []byte)
+}
+
+// instanceID identifies this process in relayed placements.
+var instanceID = newSessionID()
+
+// relaySeq numbers the placements this instance relays.
+var relaySeq atomic.Uint64
+
+// relayHeaderSize is the size of the instance ID and sequence number
+// prefixed to relayed broadcasts.
+const relayHeaderSize = len(instanceID) + 8
+
+// relayPayload prefixes a MsgTypeBroadcast or MsgTypeBatchBroadcast with
+// instanceID and the next sequence number.
+func relayPayload(bcast []byte) []byte {
+	payload := make([]byte, relayHeaderSize, relayHeaderSize+len(bcast))
+	copy(payload, instanceID[:])
+	binary.BigEndian.PutUint64(payload[len(instanceID):], relaySeq.Add(1))
+	return append(payload, bcast...)
+}
+
+// relayDedupWindow is how many sequence numbers per instance relayDedup
+// remembers. Placements are published roughly in sequence order, but
+// concurrent publishers may swap a few.
+const relayDedupWindow = 1024
+
+// relayDedup remembers the sequence numbers recently received from each
+// other instance.
+type relayDedup struct {
+	mu        sync.Mutex
+	instances map[sessionID]*relaySeqWindow
+}
+
+type relaySeqWindow struct {
+	highest uint64
+	seen    [relayDedupWindow]uint64
+}
+
+// duplicate reports whether seq from instance was seen before, recording it
+// otherwise. Sequence numbers too far behind the highest one seen are
+// treated as duplicates.
+func (d *relayDedup) duplicate(instance sessionID, seq uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.instances == nil {
+		d.instances = make(map[sessionID]*relaySeqWindow)
+	}
+	w := d.instances[instance]
+	if w == nil {
+		w = &relaySeqWindow{}
+		d.instances[instance] = w
+	}
+	if w.highest >= relayDedupWindow && seq <= w.highest-relayDedupWindow {
+		return true
+	}
+	slot := &w.seen[seq%relayDedupWindow]
+	if *slot == seq {
+		return true
+	}
+	*slot = seq
+	w.highest = max(w.highest, seq)
+	return false
+}
+
+// broadcastPlacement fans out a MsgTypeBroadcast or MsgTypeBatchBroadcast of
+// pixels placed on this instance to its clients and, if configured, to the
+// other instances through the relay.
+func (h *Hub) broadcastPlacement(bcast []byte, accepted time.Time) {
+	h.broadcast <- OutgoingMessage{messageType: websocket.BinaryMessage, data: bcast, accepted: accepted}
+	if h.relay != nil {
+		h.relay.publish(relayPayload(bcast))
+	}
+}
+
+// applyRelayed applies a placement relayed from another instance and
+// broadcasts to local clients the pixels it changed: pixels on locked panels
+// and pixels that lost to a newer local write are dropped. Relayed pixels
+// have no owner here, since client IDs are local to each instance.
+func (h *Hub) applyRelayed(payload []byte) {
+	if len(payload) < relayHeaderSize+1 {
+		slog.Debug("ignoring short relayed message", "len", len(payload))
+		return
+	}
+	origin := sessionID(payload[:len(instanceID)])
+	if origin == instanceID {
+		return
+	}
+	if h.relayDedup.duplicate(origin, binary.BigEndian.Uint64(payload[len(instanceID):relayHeaderSize])) {
+		relayDuplicatesTotal.Inc()
+		return
+	}
+	bcast := payload[relayHeaderSize:]
+
+	var r, g, b byte
+	var ts int64
+	var entries []byte
+	switch {
+	case bcast[0] == MsgTypeBroadcast && len(bcast) == 16:
+		r, g, b = bcast[5], bcast[6], bcast[7]
+		ts = int64(binary.BigEndian.Uint64(bcast[8:16]))
+		entries = bcast[1:5]
+	case bcast[0] == MsgTypeBatchBroadcast && len(bcast) >= 14 && len(bcast) == 14+int(binary.BigEndian.Uint16(bcast[1:3]))*4:
+		r, g, b = bcast[3], bcast[4], bcast[5]
+		ts = int64(binary.BigEndian.Uint64(bcast[6:14]))
+		entries = bcast[14:]
+	default:
+		slog.Debug("ignoring unknown relayed message", "type", bcast[0], "len", len(bcast))
+		return
+	}
+
+	ps := make([]int, len(entries)/4)
+	for i := range ps {
+		e := entries[i*4 : i*4+4]
+		ps[i] = int(binary.BigEndian.Uint16(e[0:2]))
+		if ps[i] >= numPanels || int(e[2]) >= panelSize || int(e[3]) >= panelSize {
+			slog.Warn("ignoring relayed placement outside the canvas; do all instances use the same -panels and -panel-size?",
+				"panel", ps[i], "x", e[2], "y", e[3])
+			return
+		}
+	}
+	// accepted holds the entries written, in the relayed order.
+	accepted := make([]byte, 0, len(entries))
+	locked := lockPanels(ps)
+	for i, panel := range ps {
+		e := entries[i*4 : i*4+4]
+		if lockedPanels[panel].Load() {
+			continue
+		}
+		if setPixel(panel, int(e[2]), int(e[3]), r, g, b, 0, ts) {
+			accepted = append(accepted, e...)
+		}
+	}
+	unlockPanels(locked)
+	if len(accepted) == 0 {
+		return
+	}
+	relayedUpdatesTotal.Add(float64(len(accepted) / 4))
+	for i := 0; i < len(accepted); i += 4 {
+		e := accepted[i : i+4]
+		panel := binary.BigEndian.Uint16(e[0:2])
+		h.activity.record(int(panel), 1)
+		if h.history != nil {
+			h.history.add(placement{Panel: panel, X: e[2], Y: e[3], R: r, G: g, B: b, Timestamp: ts})
+		}
+	}
+	msg := bytes.Clone(bcast)
+	if len(accepted) < len(entries) {
+		msg = batchBroadcastMessage(r, g, b, ts, accepted)
+	}
+	h.broadcast <- OutgoingMessage{messageType: websocket.BinaryMessage, data: msg}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// A client reconnecting after a brief disconnect can pass
+// ?resume=<unix ms>, the timestamp of the last broadcast it received, to be
+// sent the placements it missed from the history instead of syncing every
+// panel again.
+
+// maxResumeEntries caps the placements sent to a resuming client; past it a
+// full sync is cheaper.
+const maxResumeEntries = 65536
+
+// resumeEntrySize is the size of a placement in a MsgTypeResume message:
+// panel (2), x, y, r, g, b, timestamp (8).
+const resumeEntrySize = 15
+
+// parseResume returns the timestamp of a ?resume parameter, or zero if
+// there is none or it is invalid.
+func parseResume(v string) int64 {
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ts <= 0 {
+		return 0
+	}
+	return ts
+}
+
+// resumeMessage builds the MsgTypeResume message for a client resuming
+// from since. It fails, asking for a full sync, if history is disabled or
+// the gap exceeds its window.
+func (h *Hub) resumeMessage(since int64) ([]byte, bool) {
+	var missed []placement
+	ok := false
+	if h.history != nil {
+		missed, ok = h.history.window(since)
+	}
+	if !ok || len(missed) > maxResumeEntries {
+		return []byte{MsgTypeResume, 0, 0, 0, 0, 0}, false
+	}
+	buf := make([]byte, 6, 6+len(missed)*resumeEntrySize)
+	buf[0] = MsgTypeResume
+	buf[1] = 1
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(missed)))
+	for _, p := range missed {
+		buf = binary.BigEndian.AppendUint16(buf, p.Panel)
+		buf = append(buf, p.X, p.Y, p.R, p.G, p.B)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(p.Timestamp))
+	}
+	return buf, true
+}
+
+// sendResume queues the answer to client's ?resume. It runs on the hub
+// goroutine before the client is added to h.clients. Placements are added
+// to the history before their broadcast is queued, so none is lost between
+// the missed placements and the live ones, but one whose broadcast was still
+// queued is sent both ways, which is harmless since the copies arrive in
+// order.
+func (h *Hub) sendResume(client *Client) {
+	data, ok := h.resumeMessage(client.resumeSince)
+	m := OutgoingMessage{messageType: websocket.BinaryMessage, data: data}
+	if client.compress && h.compressThreshold > 0 && len(data) >= h.compressThreshold {
+		m = *compressedBroadcast(m)
+	}
+	select {
+	case client.send <- m:
+		slog.Debug("client resumed broadcasts", "remote_ip", client.ip, "since", client.resumeSince, "resumed", ok)
+	default:
+		slog.Warn("dropped resume for busy client", "remote_ip", client.ip)
+	}
+}
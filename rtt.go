@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Pings carry their send time, which clients echo in the pong as the
+// websocket spec requires, so the round-trip time is measured without any
+// per-client state.
+
+// pingPayload encodes t as the application data of a ping.
+func pingPayload(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+// recordPong measures the round-trip time of the ping answered by a pong
+// with appData, records it, and reports it to the client if asked. Pongs
+// that do not echo a ping of ours, e.g. unsolicited ones, are ignored. It
+// runs on readPump.
+func (c *Client) recordPong(appData string) {
+	if len(appData) != 8 {
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64([]byte(appData))))
+	rtt := time.Since(sent)
+	if rtt < 0 || rtt > pongWait {
+		return
+	}
+	c.rtt.Store(int64(rtt))
+	pingRTT.Observe(rtt.Seconds())
+	if c.reportRTT {
+		c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: rttMessage(rtt)})
+	}
+}
+
+// rttMessage builds a MsgTypeRTT message.
+func rttMessage(rtt time.Duration) []byte {
+	msg := make([]byte, 5)
+	msg[0] = MsgTypeRTT
+	binary.BigEndian.PutUint32(msg[1:], uint32(min(rtt.Microseconds(), 1<<32-1)))
+	return msg
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// updateOutOfScope is the MsgTypeUpdateAck result for an update to a panel
+// outside the client's scope.
+const updateOutOfScope = 2
+
+// panelScope is the set of panels a client may paint, letting moderators
+// confine a client, e.g. a bot, to the panels it has claimed. A nil
+// *panelScope allows every panel, which is the default.
+type panelScope []bool
+
+// allows reports whether the scope includes panel.
+func (s *panelScope) allows(panel int) bool {
+	return s == nil || (*s)[panel]
+}
+
+// inScope reports whether c may paint panel, answering the update with a
+// MsgTypeUpdateAck carrying updateOutOfScope if not.
+func (c *Client) inScope(panel int) bool {
+	if c.scope.Load().allows(panel) {
+		return true
+	}
+	slog.Debug("update outside client scope", "remote_ip", c.ip, "panel", panel)
+	c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUpdateAck, updateOutOfScope}})
+	return false
+}
+
+// scopeRequest is the JSON body of /admin/scope. A null or missing Panels
+// lifts the restriction; an empty list allows no panel at all.
+type scopeRequest struct {
+	Session string `json:"session"`
+	Panels  []int  `json:"panels"`
+}
+
+// serveAdminScope restricts the connected client with the given session to
+// a set of panels. The scope survives session resumption. It is a 404 if no
+// such client is connected.
+func serveAdminScope(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	var req scopeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	session, ok := parseSessionID(req.Session)
+	if !ok {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+	var scope *panelScope
+	if req.Panels != nil {
+		allowed := make(panelScope, numPanels)
+		for _, p := range req.Panels {
+			if p < 0 || p >= numPanels {
+				http.Error(w, "Panel out of range", http.StatusBadRequest)
+				return
+			}
+			allowed[p] = true
+		}
+		scope = &allowed
+	}
+	client := hub.clientBySession(session)
+	if client == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	client.scope.Store(scope)
+	slog.Info("client scope set by admin", "remote_ip", remoteIP(r), "session_hash", sessionHash(session), "panels", req.Panels)
+	w.WriteHeader(http.StatusOK)
+}
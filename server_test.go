@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readTimeout bounds how long tests wait for a message from the server.
+const readTimeout = 5 * time.Second
+
+// waitFor polls cond until it holds, failing the test with what after
+// readTimeout.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(readTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	allowedOrigins = map[string]bool{"*": true}
+	allocateCanvas()
+	os.Exit(m.Run())
+}
+
+// startTestServer runs hub and serves it from an httptest server, with
+// Turnstile disabled. The canvas is shared by every test, so tests paint
+// panels of their own.
+func startTestServer(t *testing.T, hub *Hub) *httptest.Server {
+	t.Helper()
+	hub.skipTurnstile = true
+	go hub.run()
+	srv := httptest.NewServer(newRouter(hub, nil, "", "", 512))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testClient is a websocket connection to a test server.
+type testClient struct {
+	*websocket.Conn
+	// color is the paint color assigned on connect, zero for spectators.
+	color [3]byte
+}
+
+// wsURL returns the websocket URL of srv with the given query string.
+func wsURL(srv *httptest.Server, query string) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws" + query
+}
+
+// dialTestClient connects to the websocket of srv with the given query
+// string, and waits until the hub has registered the client.
+func dialTestClient(t *testing.T, srv *httptest.Server, query string) *testClient {
+	t.Helper()
+	url := wsURL(srv, query)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{Conn: conn}
+	// The hub sends the client count once the client is registered, after
+	// the initial messages.
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for registration: %v", err)
+		}
+		switch data[0] {
+		case MsgTypeAssignColor:
+			copy(c.color[:], data[1:])
+		case MsgTypeClientCount:
+			return c
+		}
+	}
+}
+
+// read returns the next binary message of type msgType, skipping any
+// other.
+func (c *testClient) read(t *testing.T, msgType byte) []byte {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(readTimeout))
+	for {
+		typ, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for message type %d: %v", msgType, err)
+		}
+		if typ == websocket.BinaryMessage && len(data) > 0 && data[0] == msgType {
+			return data
+		}
+	}
+}
+
+// write sends data to the server as a binary message.
+func (c *testClient) write(t *testing.T, data []byte) {
+	t.Helper()
+	if err := c.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("writing message type %d: %v", data[0], err)
+	}
+}
+
+func TestUpdateAckAndBroadcast(t *testing.T) {
+	srv := startTestServer(t, newHub())
+	watcher := dialTestClient(t, srv, "")
+	painter := dialTestClient(t, srv, "")
+	r, g, b := painter.color[0], painter.color[1], painter.color[2]
+
+	before := time.Now().UnixMilli()
+	painter.write(t, []byte{MsgTypeUpdate, 0x01, 0x02, 3, 4})
+
+	if ack := painter.read(t, MsgTypeUpdateAck); !bytes.Equal(ack, []byte{MsgTypeUpdateAck, 1}) {
+		t.Errorf("update ack = %x, want %x", ack, []byte{MsgTypeUpdateAck, 1})
+	}
+	for _, conn := range []*testClient{painter, watcher} {
+		bcast := conn.read(t, MsgTypeBroadcast)
+		if len(bcast) != 16 {
+			t.Fatalf("broadcast is %d bytes, want 16: %x", len(bcast), bcast)
+		}
+		// type, panel (2), x, y, r, g, b, timestamp (8)
+		if want := []byte{MsgTypeBroadcast, 0x01, 0x02, 3, 4, r, g, b}; !bytes.Equal(bcast[:8], want) {
+			t.Errorf("broadcast = %x, want %x followed by the timestamp", bcast, want)
+		}
+		if ts := int64(binary.BigEndian.Uint64(bcast[8:])); ts < before || ts > time.Now().UnixMilli() {
+			t.Errorf("broadcast timestamp = %d, want between %d and now", ts, before)
+		}
+	}
+}
+
+func TestRequestPanelSync(t *testing.T) {
+	srv := startTestServer(t, newHub())
+	conn := dialTestClient(t, srv, "")
+	r, g, b := conn.color[0], conn.color[1], conn.color[2]
+
+	const panel = 0x0103
+	conn.write(t, []byte{MsgTypeUpdate, 0x01, 0x03, 5, 6})
+	conn.read(t, MsgTypeUpdateAck)
+	conn.write(t, []byte{MsgTypeRequest, 0x01, 0x03})
+
+	// type, panel (2), then the zlib-compressed RGB rows.
+	sync := conn.read(t, MsgTypePanelSync)
+	if !bytes.Equal(sync[:3], []byte{MsgTypePanelSync, 0x01, 0x03}) {
+		t.Fatalf("panel sync header = %x, want %x", sync[:3], []byte{MsgTypePanelSync, 0x01, 0x03})
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(sync[3:]))
+	if err != nil {
+		t.Fatalf("panel sync payload is not zlib: %v", err)
+	}
+	rgb, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("inflating panel sync: %v", err)
+	}
+	if len(rgb) != panelSize*panelSize*3 {
+		t.Fatalf("panel sync inflates to %d bytes, want %d", len(rgb), panelSize*panelSize*3)
+	}
+	for i := 0; i < len(rgb); i += 3 {
+		want := []byte{background.R, background.G, background.B}
+		if i == (6*panelSize+5)*3 {
+			want = []byte{r, g, b}
+		}
+		if !bytes.Equal(rgb[i:i+3], want) {
+			t.Fatalf("panel %d pixel (%d, %d) = %x, want %x", panel, i/3%panelSize, i/3/panelSize, rgb[i:i+3], want)
+		}
+	}
+}
+
+func TestSetPixelLastWriteWins(t *testing.T) {
+	const panel, x, y = 10, 7, 9
+	const writers = 64
+	base := time.Now().UnixMilli()
+	// Writer i paints color i at base+i; start them in a random order.
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, i := range rand.Perm(writers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			panelLocks[panel].Lock()
+			setPixel(panel, x, y, byte(i), byte(i), byte(i), uint32(i), base+int64(i))
+			panelLocks[panel].Unlock()
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	panelLocks[panel].RLock()
+	p := panels[panel][y][x]
+	panelLocks[panel].RUnlock()
+	const newest = writers - 1
+	if p.R != newest || p.G != newest || p.B != newest || p.Owner != newest {
+		t.Errorf("pixel = %d,%d,%d by %d, want %d,%d,%d by %d", p.R, p.G, p.B, p.Owner, newest, newest, newest, newest)
+	}
+	if ts := p.Timestamp(); ts != base+newest {
+		t.Errorf("pixel timestamp = %d, want %d", ts, base+newest)
+	}
+}
+
+func TestSlowClientDropped(t *testing.T) {
+	hub := newHub()
+	// Room for the initial messages and client counts, but little more.
+	hub.sendBufferSize = 8
+	srv := startTestServer(t, hub)
+	slow := dialTestClient(t, srv, "")
+
+	// The client never reads, so once the socket buffers are full its send
+	// queue fills up and the hub drops it. Large broadcasts get there fast.
+	big := OutgoingMessage{messageType: websocket.BinaryMessage, data: make([]byte, 64<<10)}
+	deadline := time.Now().Add(readTimeout)
+	for hub.clientCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow client was never dropped")
+		}
+		hub.broadcast <- big
+	}
+
+	// Its pumps must then close the connection with a close frame and
+	// release its connection slot, rather than linger.
+	slow.SetReadDeadline(time.Now().Add(readTimeout))
+	var err error
+	for err == nil {
+		_, _, err = slow.ReadMessage()
+	}
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("slow client read error = %v, want a close frame with code %d", err, websocket.CloseTryAgainLater)
+	}
+	waitFor(t, "the connection slot to be released", func() bool { return hub.conns.Load() == 0 })
+}
+
+func TestRegisterUnregisterStress(t *testing.T) {
+	hub := newHub()
+	srv := startTestServer(t, hub)
+
+	// Keep broadcasts flowing while clients come and go.
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(100 * time.Microsecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				hub.broadcast <- OutgoingMessage{messageType: websocket.BinaryMessage, data: broadcastMessage(11, 0, 0, 1, 2, 3, time.Now().UnixMilli())}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	const clients, rounds = 50, 5
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				conn, _, err := websocket.DefaultDialer.Dial(wsURL(srv, ""), nil)
+				if err != nil {
+					t.Errorf("dialing: %v", err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(readTimeout))
+				conn.ReadMessage()
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-stopped
+
+	waitFor(t, "every client to be unregistered", func() bool {
+		return hub.clientCount() == 0 && hub.conns.Load() == 0
+	})
+}
+
+func TestBroadcastOverload(t *testing.T) {
+	hub := newHub()
+	// Fill the queue before the hub runs, so it starts out saturated and
+	// has to shed.
+	for i := range cap(hub.broadcast) {
+		hub.broadcast <- OutgoingMessage{messageType: websocket.BinaryMessage, data: broadcastMessage(12, i%16, 0, 1, 2, 3, int64(i))}
+	}
+	srv := startTestServer(t, hub)
+	reader := dialTestClient(t, srv, "")
+	go func() {
+		for {
+			if _, _, err := reader.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Producers stand in for many painting clients, updating the same few
+	// pixels far faster than one client could.
+	const producers, updates = 8, 5000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for range producers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range updates {
+					hub.broadcastPlacement(broadcastMessage(12, i%16, 0, 1, 2, 3, int64(i)), time.Now())
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("producers still blocked on the broadcast queue; the hub is stuck")
+	}
+	// The queue is bounded, and the hub must work it back down to empty.
+	waitFor(t, "the broadcast queue to drain", func() bool { return len(hub.broadcast) == 0 })
+}
+
+func TestInvalidUpdatesRejected(t *testing.T) {
+	srv := startTestServer(t, newHub())
+	conn := dialTestClient(t, srv, "")
+
+	// update builds a MsgTypeUpdate; panel, x and y may be out of range.
+	update := func(panel, x, y int) []byte {
+		return []byte{MsgTypeUpdate, byte(panel >> 8), byte(panel), byte(x), byte(y)}
+	}
+	nack := []byte{MsgTypeUpdateAck, 0}
+	tests := []struct {
+		name string
+		msg  []byte
+		// ack is the MsgTypeUpdateAck expected in answer, nil for none.
+		ack []byte
+	}{
+		{"truncated update", []byte{MsgTypeUpdate, 0x00, 0x0d, 1}, nack},
+		{"overlong update", append(update(13, 1, 1), 0), nack},
+		{"truncated palette update", []byte{MsgTypeUpdatePalette, 0x00, 0x0d, 1, 1}, nack},
+		{"truncated batch header", []byte{MsgTypeBatchUpdate, 0x00}, nack},
+		{"truncated batch", []byte{MsgTypeBatchUpdate, 0x00, 0x02, 0x00, 0x0d, 1, 1}, nack},
+		{"unknown type", []byte{0xff, 0x00, 0x0d, 1, 1}, nil},
+		{"panel out of range", update(numPanels, 1, 1), nack},
+		{"largest panel", update(0xffff, 1, 1), nack},
+		{"x out of range", update(13, panelSize, 1), nack},
+		{"y out of range", update(13, 1, panelSize), nack},
+		{"batch entry out of range", []byte{MsgTypeBatchUpdate, 0x00, 0x02, 0x00, 0x0d, 1, 1, 0x00, 0x0d, byte(panelSize), 1}, nack},
+		{"palette index out of range", []byte{MsgTypeUpdatePalette, 0x00, 0x0d, 1, 1, byte(len(palette))}, nack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn.write(t, tt.msg)
+			// The answer to a cooldown query shows the connection is still
+			// open, and that any ack before it answered tt.msg.
+			conn.write(t, []byte{MsgTypeCooldownQuery})
+			var ack []byte
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					t.Fatalf("connection closed: %v", err)
+				}
+				if data[0] == MsgTypeUpdateAck {
+					ack = data
+				}
+				if data[0] == MsgTypeCooldown {
+					break
+				}
+			}
+			if !bytes.Equal(ack, tt.ack) {
+				t.Errorf("ack = %x, want %x", ack, tt.ack)
+			}
+		})
+	}
+}
+
+func TestPanelSyncEncodings(t *testing.T) {
+	srv := startTestServer(t, newHub())
+	const panel = 14
+	painter := dialTestClient(t, srv, "")
+	painter.write(t, []byte{MsgTypeUpdate, 0x00, panel, 9, 8})
+	painter.read(t, MsgTypeUpdateAck)
+	want := make([]byte, panelSize*panelSize*3)
+	panelLocks[panel].RLock()
+	copyPanelRGB(want, panel)
+	panelLocks[panel].RUnlock()
+
+	tests := []struct {
+		name     string
+		encoding byte
+		inflate  func(io.Reader) (io.Reader, error)
+	}{
+		{"raw", encodingRaw, func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{"zlib", encodingZlib, func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) }},
+		{"gzip", encodingGzip, func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialTestClient(t, srv, "?sync-encoding="+tt.name)
+			conn.write(t, []byte{MsgTypeRequest, 0x00, panel})
+
+			// type, panel (2), encoding, then the encoded RGB rows.
+			sync := conn.read(t, MsgTypePanelSyncEncoded)
+			if header := []byte{MsgTypePanelSyncEncoded, 0x00, panel, tt.encoding}; !bytes.Equal(sync[:4], header) {
+				t.Fatalf("panel sync header = %x, want %x", sync[:4], header)
+			}
+			r, err := tt.inflate(bytes.NewReader(sync[4:]))
+			if err != nil {
+				t.Fatalf("opening payload: %v", err)
+			}
+			rgb, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("inflating payload: %v", err)
+			}
+			if !bytes.Equal(rgb, want) {
+				t.Errorf("panel sync inflates to %d bytes that do not match the panel's %d", len(rgb), len(want))
+			}
+		})
+	}
+}
+
+func TestPaletteOnlySnapsColors(t *testing.T) {
+	hub := newHub()
+	hub.paletteOnly = true
+	srv := startTestServer(t, hub)
+	conn := dialTestClient(t, srv, "")
+
+	inPalette := func(c [3]byte) bool {
+		for _, p := range palette {
+			if c == [3]byte{p.R, p.G, p.B} {
+				return true
+			}
+		}
+		return false
+	}
+	if !inPalette(conn.color) {
+		t.Errorf("assigned color %x is not in the palette", conn.color)
+	}
+	// 0xfe4001 is closest to the palette's 0xff4500.
+	conn.write(t, []byte{MsgTypeSetColor, 0xfe, 0x40, 0x01})
+	if got, want := conn.read(t, MsgTypeAssignColor), []byte{MsgTypeAssignColor, 0xff, 0x45, 0x00}; !bytes.Equal(got, want) {
+		t.Errorf("set-color echo = %x, want %x", got, want)
+	}
+}
+
+func TestSpectatorRejections(t *testing.T) {
+	srv := startTestServer(t, newHub())
+	conn := dialTestClient(t, srv, "?spectator=1")
+
+	conn.write(t, []byte{MsgTypeUpdate, 0x00, 0x11, 1, 1})
+	if got, want := conn.read(t, MsgTypeUpdateAck), []byte{MsgTypeUpdateAck, updateSpectator}; !bytes.Equal(got, want) {
+		t.Errorf("update ack = %x, want %x", got, want)
+	}
+	conn.write(t, []byte{MsgTypeUndo})
+	if got, want := conn.read(t, MsgTypeUndoAck), []byte{MsgTypeUndoAck, 0}; !bytes.Equal(got, want) {
+		t.Errorf("undo ack = %x, want %x", got, want)
+	}
+}
+
+func TestApplyRelayedDropsRejectedPixels(t *testing.T) {
+	hub := newHub()
+	const panel = 18
+	ts := time.Now().UnixMilli()
+	// A newer local write wins over the relayed pixel at (1, 1).
+	panelLocks[panel].Lock()
+	setPixel(panel, 1, 1, 1, 2, 3, 0, ts+1000)
+	panelLocks[panel].Unlock()
+
+	entries := []byte{0, panel, 1, 1, 0, panel, 2, 2}
+	origin := newSessionID()
+	payload := append(origin[:], 0, 0, 0, 0, 0, 0, 0, 1)
+	payload = append(payload, batchBroadcastMessage(9, 9, 9, ts, entries)...)
+	hub.applyRelayed(payload)
+
+	select {
+	case m := <-hub.broadcast:
+		if want := batchBroadcastMessage(9, 9, 9, ts, []byte{0, panel, 2, 2}); !bytes.Equal(m.data, want) {
+			t.Errorf("broadcast = %x, want %x", m.data, want)
+		}
+	default:
+		t.Fatal("no broadcast for the accepted pixel")
+	}
+	if p := panels[panel][1][1]; p.R != 1 {
+		t.Errorf("relayed pixel overwrote a newer local write: %+v", p)
+	}
+
+	const locked = 19
+	lockedPanels[locked].Store(true)
+	defer lockedPanels[locked].Store(false)
+	payload = append(origin[:], 0, 0, 0, 0, 0, 0, 0, 2)
+	payload = append(payload, batchBroadcastMessage(9, 9, 9, ts, []byte{0, locked, 3, 3})...)
+	hub.applyRelayed(payload)
+	select {
+	case m := <-hub.broadcast:
+		t.Errorf("broadcast %x for a locked panel", m.data)
+	default:
+	}
+	if p := panels[locked][3][3]; p.R == 9 {
+		t.Errorf("relayed pixel written to a locked panel: %+v", p)
+	}
+}
+
+func TestHistoryWindowOutOfOrder(t *testing.T) {
+	h := newHistoryBuffer(3)
+	h.created = 0
+	at := func(ts ...int64) []placement {
+		ps := []placement{}
+		for _, v := range ts {
+			ps = append(ps, placement{Timestamp: v})
+		}
+		return ps
+	}
+	// The relayed placement at 100 arrives after the local one at 300.
+	for _, p := range at(300, 100, 200) {
+		h.add(p)
+	}
+	got, ok := h.window(150)
+	if want := at(300, 200); !ok || !slices.Equal(got, want) {
+		t.Errorf("window(150) = %v, %t; want %v, true", got, ok, want)
+	}
+	// Overwriting the placement at 300 leaves the window since 150
+	// incomplete, but not the one since 300.
+	h.add(placement{Timestamp: 400})
+	if _, ok := h.window(150); ok {
+		t.Error("window(150) complete after a newer placement was overwritten")
+	}
+	if got, ok := h.window(300); !ok || !slices.Equal(got, at(400)) {
+		t.Errorf("window(300) = %v, %t; want %v, true", got, ok, at(400))
+	}
+}
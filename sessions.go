@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// sessionStore keeps the state of recently disconnected clients so a client
+// reconnecting with its session ID gets back its color, owner ID, nickname,
+// cooldown, flood penalty and panel scope instead of fresh ones. Entries
+// expire after ttl.
+type sessionStore struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[sessionID]sessionState
+}
+
+type sessionState struct {
+	id           uint32
+	r, g, b      byte
+	nickname     string
+	scope        *panelScope
+	lastPlaced   time.Time
+	floodedUntil time.Time
+	expires      time.Time
+}
+
+func newSessionStore(ttl time.Duration) *sessionStore {
+	return &sessionStore{
+		ttl:     ttl,
+		entries: make(map[sessionID]sessionState),
+	}
+}
+
+// save records the state of a disconnecting client and drops expired
+// entries. Only readPump may call it, since it reads c.lastPlaced and
+// c.floodedUntil.
+func (ss *sessionStore) save(c *Client) {
+	now := time.Now()
+	r, g, b := c.getColor()
+	c.hub.mu.Lock()
+	nickname := c.nickname
+	c.hub.mu.Unlock()
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for s, e := range ss.entries {
+		if now.After(e.expires) {
+			delete(ss.entries, s)
+		}
+	}
+	ss.entries[c.session] = sessionState{
+		id:           c.id,
+		r:            r,
+		g:            g,
+		b:            b,
+		nickname:     nickname,
+		scope:        c.scope.Load(),
+		lastPlaced:   c.lastPlaced,
+		floodedUntil: c.floodedUntil,
+		expires:      now.Add(ss.ttl),
+	}
+}
+
+// take removes and returns the saved state for session, if it has not
+// expired. Taking it ensures two connections never share a session.
+func (ss *sessionStore) take(session sessionID) (sessionState, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	e, ok := ss.entries[session]
+	if !ok {
+		return sessionState{}, false
+	}
+	delete(ss.entries, session)
+	if time.Now().After(e.expires) {
+		return sessionState{}, false
+	}
+	return e, true
+}
+
+// parseSessionID decodes a hex session ID as sent in the session query
+// parameter.
+func parseSessionID(s string) (sessionID, bool) {
+	var id sessionID
+	if hex.DecodedLen(len(s)) != len(id) {
+		return id, false
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, false
+	}
+	return id, true
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary snapshots ("<unix timestamp>.bin") sit next to the PNG of the same
+// timestamp and keep what the PNG cannot: each pixel's placement timestamp,
+// so last-write-wins ordering survives a restart. The file is a zlib stream
+// of a header followed by every pixel, panel by panel, row by row:
+//
+//	magic "GOWS", version(1), numPanels(2), panelSize(2)
+//	then per pixel: r, g, b, timestamp(8)
+//
+// All integers are big-endian.
+const (
+	stateMagic      = "GOWS"
+	stateVersion    = 1
+	stateHeaderSize = len(stateMagic) + 5
+	statePixelSize  = 11
+)
+
+// stateName returns the file name or object key suffix of the binary
+// snapshot taken at ts.
+func stateName(ts int64) string {
+	return fmt.Sprintf("%d.bin", ts)
+}
+
+// encodeCanvasState returns the binary snapshot of all panels. Each panel
+// is copied under the read lock on its own so that painting is never
+// blocked for the whole encode.
+func encodeCanvasState() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+
+	header := make([]byte, stateHeaderSize)
+	copy(header, stateMagic)
+	header[4] = stateVersion
+	binary.BigEndian.PutUint16(header[5:7], uint16(numPanels))
+	binary.BigEndian.PutUint16(header[7:9], uint16(panelSize))
+	if _, err := zw.Write(header); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, panelSize*panelSize*statePixelSize)
+	for i := 0; i < numPanels; i++ {
+		off := 0
+		panelLocks[i].RLock()
+		for y := 0; y < panelSize; y++ {
+			for x := 0; x < panelSize; x++ {
+				p := panels[i][y][x]
+				data[off] = p.R
+				data[off+1] = p.G
+				data[off+2] = p.B
+				binary.BigEndian.PutUint64(data[off+3:off+11], uint64(p.Timestamp()))
+				off += statePixelSize
+			}
+		}
+		panelLocks[i].RUnlock()
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// applyCanvasState decodes a binary snapshot into the panels. On error the
+// panels may be partially overwritten; the caller falls back to the PNG,
+// which covers every pixel.
+func applyCanvasState(state []byte) error {
+	zr, err := zlib.NewReader(bytes.NewReader(state))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	r := bufio.NewReader(zr)
+
+	header := make([]byte, stateHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:4]) != stateMagic {
+		return errors.New("not a binary snapshot")
+	}
+	if header[4] != stateVersion {
+		return fmt.Errorf("unsupported binary snapshot version %d", header[4])
+	}
+	n := int(binary.BigEndian.Uint16(header[5:7]))
+	size := int(binary.BigEndian.Uint16(header[7:9]))
+	if n != numPanels || size != panelSize {
+		return fmt.Errorf("binary snapshot has %d panels of %d pixels, expected %d of %d", n, size, numPanels, panelSize)
+	}
+
+	data := make([]byte, panelSize*panelSize*statePixelSize)
+	for i := 0; i < numPanels; i++ {
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		off := 0
+		panelLocks[i].Lock()
+		for y := 0; y < panelSize; y++ {
+			for x := 0; x < panelSize; x++ {
+				p := Pixel{R: data[off], G: data[off+1], B: data[off+2]}
+				p.setTimestamp(int64(binary.BigEndian.Uint64(data[off+3 : off+11])))
+				panels[i][y][x] = p
+				off += statePixelSize
+			}
+		}
+		panelLocks[i].Unlock()
+	}
+	return nil
+}
+
+// Timestamp sidecars ("panels/<panel>.ts") do the same for incremental
+// panel snapshots: each sits next to the PNG of its panel and holds the
+// timestamps of its pixels, row by row, as a zlib stream of
+//
+//	magic "GOWT", version(1), panelSize(2)
+//	then per pixel: timestamp(8)
+const (
+	timestampsMagic      = "GOWT"
+	timestampsVersion    = 1
+	timestampsHeaderSize = len(timestampsMagic) + 3
+)
+
+// panelTimestampsName returns the file name or object key suffix, within
+// the panel snapshot directory, of the timestamp sidecar of panel.
+func panelTimestampsName(panel int) string {
+	return fmt.Sprintf("%d.ts", panel)
+}
+
+// encodePanelTimestamps returns the timestamp sidecar of panel. The caller
+// must hold the panel's lock.
+func encodePanelTimestamps(panel int) ([]byte, error) {
+	data := make([]byte, timestampsHeaderSize, timestampsHeaderSize+panelSize*panelSize*8)
+	copy(data, timestampsMagic)
+	data[4] = timestampsVersion
+	binary.BigEndian.PutUint16(data[5:7], uint16(panelSize))
+	for y := 0; y < panelSize; y++ {
+		for x := 0; x < panelSize; x++ {
+			data = binary.BigEndian.AppendUint64(data, uint64(panels[panel][y][x].Timestamp()))
+		}
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// applyPanelTimestamps restores the pixel timestamps of panel from its
+// sidecar, leaving the colors alone. Nothing is changed on error.
+func applyPanelTimestamps(panel int, sidecar []byte) error {
+	zr, err := zlib.NewReader(bytes.NewReader(sidecar))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	data := make([]byte, timestampsHeaderSize+panelSize*panelSize*8)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return err
+	}
+	if string(data[:4]) != timestampsMagic {
+		return errors.New("not a timestamp sidecar")
+	}
+	if data[4] != timestampsVersion {
+		return fmt.Errorf("unsupported timestamp sidecar version %d", data[4])
+	}
+	if size := int(binary.BigEndian.Uint16(data[5:7])); size != panelSize {
+		return fmt.Errorf("timestamp sidecar is for panels of %d pixels, expected %d", size, panelSize)
+	}
+
+	off := timestampsHeaderSize
+	panelLocks[panel].Lock()
+	defer panelLocks[panel].Unlock()
+	for y := 0; y < panelSize; y++ {
+		for x := 0; x < panelSize; x++ {
+			panels[panel][y][x].setTimestamp(int64(binary.BigEndian.Uint64(data[off : off+8])))
+			off += 8
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// snapshotFormat is an image encoding for snapshots, selected with
+// -snapshot-format. All are lossless, so a snapshot always restores the
+// exact canvas; they trade encoding time for size:
+//
+//   - png: the default, and the only format older servers can load. About
+//     a second for a full, busy 3584×3840 canvas.
+//   - png-best: PNG at maximum compression, around 5% smaller than png for
+//     about seven times the encoding time; rarely worth it.
+//   - webp: lossless WebP, around 20% smaller than png on a busy canvas
+//     and far smaller on a sparse one, for about five times the encoding
+//     time. Prefer it when storing or transferring snapshots costs more
+//     than CPU, e.g. on S3, and with incremental snapshots, whose small
+//     panel images encode quickly.
+//
+// The encoding is recorded in the file extension, so snapshots in every
+// format load whatever the current setting.
+type snapshotFormat struct {
+	name        string
+	ext         string
+	contentType string
+	encode      func(io.Writer, image.Image) error
+}
+
+var snapshotFormats = []snapshotFormat{
+	{name: "png", ext: ".png", contentType: "image/png", encode: png.Encode},
+	{name: "png-best", ext: ".png", contentType: "image/png", encode: (&png.Encoder{CompressionLevel: png.BestCompression}).Encode},
+	{name: "webp", ext: ".webp", contentType: "image/webp", encode: func(w io.Writer, img image.Image) error {
+		return nativewebp.Encode(w, img, nil)
+	}},
+}
+
+// defaultSnapshotFormat is png, readable by every server version.
+var defaultSnapshotFormat = snapshotFormats[0]
+
+// snapshotExts are the file extensions of snapshot images, in the order
+// they are looked for.
+var snapshotExts = []string{".png", ".webp"}
+
+// parseSnapshotFormat returns the format called name.
+func parseSnapshotFormat(name string) (snapshotFormat, bool) {
+	for _, f := range snapshotFormats {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return snapshotFormat{}, false
+}
+
+// cutSnapshotExt removes the extension of a snapshot image from name,
+// reporting false if it has none.
+func cutSnapshotExt(name string) (string, bool) {
+	for _, ext := range snapshotExts {
+		if base, ok := strings.CutSuffix(name, ext); ok {
+			return base, true
+		}
+	}
+	return "", false
+}
+
+// decodeSnapshotImage decodes a snapshot image named name, choosing the
+// decoder by its extension.
+func decodeSnapshotImage(name string, r io.Reader) (image.Image, error) {
+	switch path.Ext(name) {
+	case ".png":
+		return png.Decode(r)
+	case ".webp":
+		return nativewebp.Decode(r)
+	}
+	return nil, fmt.Errorf("unknown snapshot image extension %q", path.Ext(name))
+}
+
+// decodeSnapshotFile decodes the snapshot image at filename.
+func decodeSnapshotFile(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeSnapshotImage(filename, f)
+}
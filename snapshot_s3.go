@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Timeout bounds each S3 operation.
+const s3Timeout = time.Minute
+
+// s3SnapshotStore keeps image snapshots as "<prefix><unix timestamp>.png"
+// (or .webp, depending on the format) objects in an S3 bucket, binary
+// snapshots as "<prefix><unix timestamp>.bin" and incremental panel
+// snapshots as "<prefix>panels/<panel>.png". New images are written in
+// format. Uploads are atomic, so no temporary objects are needed.
+type s3SnapshotStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+	format snapshotFormat
+}
+
+// newS3SnapshotStore creates a store for bucket using the default AWS
+// configuration chain (environment, shared config, instance role).
+func newS3SnapshotStore(ctx context.Context, bucket, prefix string, format snapshotFormat) (*s3SnapshotStore, error) {
+	if bucket == "" {
+		return nil, errors.New("an S3 bucket is required")
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &s3SnapshotStore{client: s3.NewFromConfig(cfg), bucket: bucket, prefix: prefix, format: format}, nil
+}
+
+// s3Snapshot is a snapshot object, identified by the timestamp in its key.
+type s3Snapshot struct {
+	key       string
+	timestamp int64
+}
+
+// list returns the snapshot objects under the prefix, oldest first.
+func (s *s3SnapshotStore) list(ctx context.Context) ([]s3Snapshot, error) {
+	var snapshots []s3Snapshot
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			name := strings.TrimPrefix(key, s.prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+			ts, ok := parseSnapshotName(name)
+			if !ok {
+				continue
+			}
+			snapshots = append(snapshots, s3Snapshot{key: key, timestamp: ts})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].timestamp < snapshots[j].timestamp
+	})
+	return snapshots, nil
+}
+
+func (s *s3SnapshotStore) Save(ts int64, img image.Image) error {
+	key := s.prefix + snapshotName(ts, s.format.ext)
+	if err := s.put(key, img); err != nil {
+		return err
+	}
+	slog.Info("snapshot saved", "bucket", s.bucket, "key", key)
+	return nil
+}
+
+func (s *s3SnapshotStore) SavePanel(ts int64, panel int, img image.Image) error {
+	return s.put(fmt.Sprintf("%s%s/%d%s", s.prefix, panelSnapshotDir, panel, s.format.ext), img)
+}
+
+func (s *s3SnapshotStore) SaveState(ts int64, state []byte) error {
+	return s.putBytes(s.prefix+stateName(ts), state)
+}
+
+func (s *s3SnapshotStore) LoadState(ts int64) ([]byte, error) {
+	return s.getBytes(s.prefix + stateName(ts))
+}
+
+func (s *s3SnapshotStore) SavePanelTimestamps(panel int, sidecar []byte) error {
+	return s.putBytes(s.prefix+panelSnapshotDir+"/"+panelTimestampsName(panel), sidecar)
+}
+
+func (s *s3SnapshotStore) LoadPanelTimestamps(panel int) ([]byte, error) {
+	return s.getBytes(s.prefix + panelSnapshotDir + "/" + panelTimestampsName(panel))
+}
+
+func (s *s3SnapshotStore) SaveLockedPanels(sidecar []byte) error {
+	return s.putBytes(s.prefix+lockedPanelsName, sidecar)
+}
+
+func (s *s3SnapshotStore) LoadLockedPanels() ([]byte, error) {
+	return s.getBytes(s.prefix + lockedPanelsName)
+}
+
+// putBytes uploads data as a binary object at key.
+func (s *s3SnapshotStore) putBytes(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/octet-stream"),
+	})
+	return err
+}
+
+// getBytes downloads the object at key, returning errNoSnapshot if there is
+// none.
+func (s *s3SnapshotStore) getBytes(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var noKey *types.NoSuchKey
+	if errors.As(err, &noKey) {
+		return nil, errNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// put uploads img as an object at key, encoded in the store's format.
+func (s *s3SnapshotStore) put(key string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := s.format.encode(&buf, img); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String(s.format.contentType),
+	})
+	return err
+}
+
+// LoadPanels decodes the panel snapshot objects last modified at or after
+// since. If a panel has snapshots in several formats, the newest wins.
+func (s *s3SnapshotStore) LoadPanels(since int64) (map[int]image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	imgs := make(map[int]image.Image)
+	modTimes := make(map[int]time.Time)
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix + panelSnapshotDir + "/"),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			panel, ok := parsePanelSnapshotName(path.Base(key))
+			modTime := aws.ToTime(obj.LastModified)
+			if !ok || modTime.Unix() < since {
+				continue
+			}
+			if t, ok := modTimes[panel]; ok && !modTime.After(t) {
+				continue
+			}
+			img, err := s.decode(ctx, key)
+			if err != nil {
+				slog.Warn("skipping unusable panel snapshot", "bucket", s.bucket, "key", key, "err", err)
+				continue
+			}
+			imgs[panel] = img
+			modTimes[panel] = modTime
+		}
+	}
+	return imgs, nil
+}
+
+// LoadLatest decodes the most recent snapshot object, skipping unreadable
+// ones in favor of the next most recent.
+func (s *s3SnapshotStore) LoadLatest() (image.Image, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	snapshots, err := s.list(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		key := snapshots[i].key
+		img, err := s.decode(ctx, key)
+		if err != nil {
+			slog.Warn("skipping unusable snapshot", "bucket", s.bucket, "key", key, "err", err)
+			continue
+		}
+		slog.Info("read snapshot", "bucket", s.bucket, "key", key)
+		return img, snapshots[i].timestamp, nil
+	}
+	return nil, 0, errNoSnapshot
+}
+
+func (s *s3SnapshotStore) List() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	snapshots, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make([]int64, len(snapshots))
+	for i, snap := range snapshots {
+		timestamps[i] = snap.timestamp
+	}
+	return timestamps, nil
+}
+
+// Load decodes the snapshot taken at ts, in whichever format it was saved.
+func (s *s3SnapshotStore) Load(ts int64) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	var err error
+	for _, ext := range snapshotExts {
+		var img image.Image
+		img, err = s.decode(ctx, s.prefix+snapshotName(ts, ext))
+		var noKey *types.NoSuchKey
+		if !errors.As(err, &noKey) {
+			return img, err
+		}
+	}
+	return nil, err
+}
+
+func (s *s3SnapshotStore) decode(ctx context.Context, key string) (image.Image, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return decodeSnapshotImage(key, out.Body)
+}
+
+// Prune deletes the snapshot objects that fall outside the retention
+// policy.
+func (s *s3SnapshotStore) Prune(retention snapshotRetention) error {
+	if retention == (snapshotRetention{}) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	snapshots, err := s.list(ctx)
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	now := time.Now()
+	for i, snap := range snapshots {
+		if !retention.expired(i, len(snapshots), snap.timestamp, now) {
+			continue
+		}
+		_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(snap.key),
+		})
+		if err != nil {
+			slog.Error("pruning snapshot", "bucket", s.bucket, "key", snap.key, "err", err)
+			continue
+		}
+		stateKey := s.prefix + stateName(snap.timestamp)
+		_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(stateKey),
+		})
+		if err != nil {
+			slog.Error("pruning binary snapshot", "bucket", s.bucket, "key", stateKey, "err", err)
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		slog.Info("pruned old snapshots", "count", pruned, "kept", len(snapshots)-pruned)
+	}
+	return nil
+}
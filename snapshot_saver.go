@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotRetryMin and snapshotRetryMax bound the delay before retrying
+	// a failed snapshot. It doubles with each consecutive failure.
+	snapshotRetryMin = 10 * time.Second
+	snapshotRetryMax = 10 * time.Minute
+)
+
+// snapshotHealth tracks consecutive snapshot failures, such as a full disk
+// or a data directory that lost write permission, for /healthz.
+type snapshotHealth struct {
+	mu       sync.Mutex
+	failures int
+	since    time.Time
+	lastErr  error
+}
+
+// snapshotStatus is the health of the snapshot saver.
+var snapshotStatus snapshotHealth
+
+// failed records a failed snapshot and returns how long to wait before
+// retrying.
+func (h *snapshotHealth) failed(err error) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.failures == 0 {
+		h.since = time.Now()
+	}
+	h.failures++
+	h.lastErr = err
+	snapshotFailures.Set(float64(h.failures))
+	return min(snapshotRetryMin<<min(h.failures-1, 16), snapshotRetryMax)
+}
+
+// succeeded records a successful snapshot and returns how many failures
+// preceded it.
+func (h *snapshotHealth) succeeded() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.failures
+	h.failures = 0
+	h.lastErr = nil
+	snapshotFailures.Set(0)
+	return n
+}
+
+// status returns the number of consecutive failures, when they started and
+// the last error, or zero values if snapshots are healthy.
+func (h *snapshotHealth) status() (failures int, since time.Time, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures, h.since, h.lastErr
+}
+
+// panelsChanged is signalled, without blocking, when a clean panel becomes
+// dirty. It wakes the snapshot saver for debounced snapshots; since only the
+// first change to a panel after a snapshot signals, a busy canvas sends at
+// most numPanels signals per snapshot.
+var panelsChanged = make(chan struct{}, 1)
+
+// markPanelDirty flags panel for the next snapshot.
+func markPanelDirty(panel int) {
+	if !dirtyPanels[panel].Swap(true) {
+		select {
+		case panelsChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runSnapshotSaver snapshots the canvas to store until the process exits.
+//
+// With a non-zero debounce, the first change after a snapshot schedules the
+// next one debounce later, so a burst of activity is captured shortly after
+// it starts and coalesced into a single save; sustained activity is saved
+// every debounce. With a non-zero interval, a snapshot is also taken if none
+// was for that long, which bounds the data lost in a crash even when
+// debouncing is off. Unchanged canvases are never saved.
+//
+// A failed snapshot is retried after a delay doubling from snapshotRetryMin
+// to snapshotRetryMax, and other snapshots are held off until then, so a
+// full or read-only disk neither floods the log nor takes the server down.
+// The failure shows in /healthz until a snapshot succeeds again.
+func runSnapshotSaver(store SnapshotStore, opts snapshotOptions, retention snapshotRetention, interval, debounce time.Duration) {
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var changed <-chan struct{}
+	if debounce > 0 {
+		changed = panelsChanged
+	}
+	// pending fires the scheduled debounced snapshot; nil if none is.
+	var pending <-chan time.Time
+	// retry fires when a failed snapshot is due to be retried; nil unless
+	// the last one failed.
+	var retry <-chan time.Time
+
+	save := func() {
+		if retry != nil {
+			return
+		}
+		saved, err := snapshotPanels(store, opts)
+		if err != nil {
+			delay := snapshotStatus.failed(err)
+			retry = time.After(delay)
+			slog.Error("snapshot failed", "err", err, "retry_in", delay)
+		} else if n := snapshotStatus.succeeded(); n > 0 {
+			slog.Info("snapshots recovered", "failures", n)
+		}
+		if saved {
+			if err := store.Prune(retention); err != nil {
+				slog.Error("pruning snapshots", "err", err)
+			}
+		}
+		if ticker != nil {
+			ticker.Reset(interval)
+		}
+	}
+	for {
+		select {
+		case <-changed:
+			if pending == nil {
+				pending = time.After(debounce)
+			}
+		case <-pending:
+			pending = nil
+			save()
+		case <-retry:
+			retry = nil
+			save()
+		case <-tick:
+			save()
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// errNoSnapshot is returned by SnapshotStore.LoadLatest when the store holds
+// no snapshot.
+var errNoSnapshot = errors.New("no snapshot found")
+
+// A SnapshotStore persists composite canvas snapshots.
+type SnapshotStore interface {
+	// Save stores img as the snapshot taken at Unix time ts.
+	Save(ts int64, img image.Image) error
+	// LoadLatest returns the most recent readable snapshot and its
+	// timestamp, or errNoSnapshot.
+	LoadLatest() (image.Image, int64, error)
+	// List returns the timestamps of the stored snapshots, oldest first.
+	List() ([]int64, error)
+	// Load returns the snapshot taken at ts.
+	Load(ts int64) (image.Image, error)
+	// SavePanel stores img as the incremental snapshot of one panel taken at
+	// Unix time ts, replacing any previous one.
+	SavePanel(ts int64, panel int, img image.Image) error
+	// LoadPanels returns the panel snapshots saved at or after since, keyed
+	// by panel number.
+	LoadPanels(since int64) (map[int]image.Image, error)
+	// SaveState stores the binary snapshot taken at Unix time ts, next to
+	// the image of the same timestamp.
+	SaveState(ts int64, state []byte) error
+	// LoadState returns the binary snapshot taken at ts, or errNoSnapshot.
+	LoadState(ts int64) ([]byte, error)
+	// SavePanelTimestamps stores the timestamp sidecar of panel next to its
+	// incremental snapshot, replacing any previous one.
+	SavePanelTimestamps(panel int, sidecar []byte) error
+	// LoadPanelTimestamps returns the timestamp sidecar of panel, or
+	// errNoSnapshot.
+	LoadPanelTimestamps(panel int) ([]byte, error)
+	// SaveLockedPanels stores the locked panels sidecar, replacing any
+	// previous one.
+	SaveLockedPanels(sidecar []byte) error
+	// LoadLockedPanels returns the locked panels sidecar, or errNoSnapshot.
+	LoadLockedPanels() ([]byte, error)
+	// Prune deletes snapshots outside the retention policy, always keeping
+	// the most recent one. Binary snapshots go with their image.
+	Prune(retention snapshotRetention) error
+}
+
+// snapshotName returns the file name or object key suffix of the snapshot
+// taken at ts, encoded in the format with extension ext.
+func snapshotName(ts int64, ext string) string {
+	return fmt.Sprintf("%d%s", ts, ext)
+}
+
+// parseSnapshotName extracts the timestamp from a snapshot name, reporting
+// false for names that are not "<unix timestamp>.<image extension>".
+func parseSnapshotName(name string) (int64, bool) {
+	base, ok := cutSnapshotExt(name)
+	if !ok {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(base, 10, 64)
+	if err != nil || ts < 0 {
+		return 0, false
+	}
+	return ts, true
+}
+
+// lockedPanelsName is the name (or key suffix) of the sidecar listing the
+// locked panels. It is kept apart from the snapshots, so pruning never
+// removes it.
+const lockedPanelsName = "locked_panels.json"
+
+// panelSnapshotDir is the subdirectory (or key prefix) holding incremental
+// panel snapshots named "<panel>.<image extension>".
+const panelSnapshotDir = "panels"
+
+// parsePanelSnapshotName extracts the panel number from a panel snapshot
+// name.
+func parsePanelSnapshotName(name string) (int, bool) {
+	base, ok := cutSnapshotExt(name)
+	if !ok {
+		return 0, false
+	}
+	panel, err := strconv.Atoi(base)
+	return panel, err == nil
+}
+
+// localSnapshotStore keeps image snapshots named "<unix timestamp>.png" (or
+// .webp, depending on the format) in a local directory, binary snapshots
+// beside them as "<unix timestamp>.bin", and incremental panel snapshots in
+// its panels subdirectory. New images are written in format.
+type localSnapshotStore struct {
+	dir    string
+	format snapshotFormat
+}
+
+// snapshotFile is a snapshot in the data directory, identified by the Unix
+// timestamp in its name.
+type snapshotFile struct {
+	name      string
+	timestamp int64
+}
+
+// list returns the snapshots in the directory, oldest first. Files whose
+// name is not "<unix timestamp>.<image extension>" are ignored. Ordering is
+// numeric, so it stays correct when timestamps change digit count.
+func (s *localSnapshotStore) list() ([]snapshotFile, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []snapshotFile
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		ts, ok := parseSnapshotName(file.Name())
+		if !ok {
+			slog.Debug("ignoring file with unexpected snapshot name", "file", file.Name())
+			continue
+		}
+		snapshots = append(snapshots, snapshotFile{name: file.Name(), timestamp: ts})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].timestamp < snapshots[j].timestamp
+	})
+	return snapshots, nil
+}
+
+// Save writes img as the snapshot taken at ts.
+func (s *localSnapshotStore) Save(ts int64, img image.Image) error {
+	filename := filepath.Join(s.dir, snapshotName(ts, s.format.ext))
+	if err := writeImageAtomic(filename, img, s.format); err != nil {
+		return err
+	}
+	slog.Info("snapshot saved", "file", filename)
+	return nil
+}
+
+// SavePanel writes img as the latest snapshot of panel.
+func (s *localSnapshotStore) SavePanel(ts int64, panel int, img image.Image) error {
+	dir := filepath.Join(s.dir, panelSnapshotDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("%d%s", panel, s.format.ext))
+	if err := writeImageAtomic(filename, img, s.format); err != nil {
+		return err
+	}
+	// Record the snapshot time so LoadPanels can compare it with full
+	// snapshots.
+	t := time.Unix(ts, 0)
+	return os.Chtimes(filename, t, t)
+}
+
+// LoadPanels decodes the panel snapshots modified at or after since. If a
+// panel has snapshots in several formats, the newest wins.
+func (s *localSnapshotStore) LoadPanels(since int64) (map[int]image.Image, error) {
+	dir := filepath.Join(s.dir, panelSnapshotDir)
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	imgs := make(map[int]image.Image)
+	modTimes := make(map[int]time.Time)
+	for _, file := range files {
+		panel, ok := parsePanelSnapshotName(file.Name())
+		if !ok {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || info.ModTime().Unix() < since {
+			continue
+		}
+		if t, ok := modTimes[panel]; ok && !info.ModTime().After(t) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		img, err := decodeSnapshotFile(path)
+		if err != nil {
+			slog.Warn("skipping unusable panel snapshot", "file", path, "err", err)
+			continue
+		}
+		imgs[panel] = img
+		modTimes[panel] = info.ModTime()
+	}
+	return imgs, nil
+}
+
+// SaveState writes the binary snapshot taken at ts.
+func (s *localSnapshotStore) SaveState(ts int64, state []byte) error {
+	return writeFileAtomic(filepath.Join(s.dir, stateName(ts)), func(w io.Writer) error {
+		_, err := w.Write(state)
+		return err
+	})
+}
+
+// LoadState reads the binary snapshot taken at ts.
+func (s *localSnapshotStore) LoadState(ts int64) ([]byte, error) {
+	state, err := os.ReadFile(filepath.Join(s.dir, stateName(ts)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSnapshot
+	}
+	return state, err
+}
+
+func (s *localSnapshotStore) SavePanelTimestamps(panel int, sidecar []byte) error {
+	return writeFileAtomic(filepath.Join(s.dir, panelSnapshotDir, panelTimestampsName(panel)), func(w io.Writer) error {
+		_, err := w.Write(sidecar)
+		return err
+	})
+}
+
+func (s *localSnapshotStore) LoadPanelTimestamps(panel int) ([]byte, error) {
+	sidecar, err := os.ReadFile(filepath.Join(s.dir, panelSnapshotDir, panelTimestampsName(panel)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSnapshot
+	}
+	return sidecar, err
+}
+
+func (s *localSnapshotStore) SaveLockedPanels(sidecar []byte) error {
+	return writeFileAtomic(filepath.Join(s.dir, lockedPanelsName), func(w io.Writer) error {
+		_, err := w.Write(sidecar)
+		return err
+	})
+}
+
+func (s *localSnapshotStore) LoadLockedPanels() ([]byte, error) {
+	sidecar, err := os.ReadFile(filepath.Join(s.dir, lockedPanelsName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoSnapshot
+	}
+	return sidecar, err
+}
+
+// writeImageAtomic encodes img in format to filename with writeFileAtomic.
+func writeImageAtomic(filename string, img image.Image, format snapshotFormat) error {
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		return format.encode(w, img)
+	})
+}
+
+// writeFileAtomic writes to a temporary file and renames it to filename
+// once it is complete and synced, so a crash mid-write never leaves a
+// truncated file.
+func writeFileAtomic(filename string, write func(io.Writer) error) error {
+	tmpName := filename + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+func (s *localSnapshotStore) List() ([]int64, error) {
+	snapshots, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	timestamps := make([]int64, len(snapshots))
+	for i, snap := range snapshots {
+		timestamps[i] = snap.timestamp
+	}
+	return timestamps, nil
+}
+
+// Load decodes the snapshot taken at ts, in whichever format it was saved.
+func (s *localSnapshotStore) Load(ts int64) (image.Image, error) {
+	var err error
+	for _, ext := range snapshotExts {
+		var img image.Image
+		img, err = decodeSnapshotFile(filepath.Join(s.dir, snapshotName(ts, ext)))
+		if !errors.Is(err, os.ErrNotExist) {
+			return img, err
+		}
+	}
+	return nil, err
+}
+
+// LoadLatest decodes the most recent snapshot, skipping unreadable ones in
+// favor of the next most recent.
+func (s *localSnapshotStore) LoadLatest() (image.Image, int64, error) {
+	snapshots, err := s.list()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		path := filepath.Join(s.dir, snapshots[i].name)
+		img, err := decodeSnapshotFile(path)
+		if err != nil {
+			slog.Warn("skipping unusable snapshot", "file", path, "err", err)
+			continue
+		}
+		slog.Info("read snapshot", "file", path)
+		return img, snapshots[i].timestamp, nil
+	}
+	return nil, 0, errNoSnapshot
+}
+
+// Prune deletes the snapshots that fall outside the retention policy.
+func (s *localSnapshotStore) Prune(retention snapshotRetention) error {
+	if retention == (snapshotRetention{}) {
+		return nil
+	}
+	snapshots, err := s.list()
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	now := time.Now()
+	for i, snap := range snapshots {
+		if !retention.expired(i, len(snapshots), snap.timestamp, now) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, snap.name)); err != nil {
+			slog.Error("pruning snapshot", "file", snap.name, "err", err)
+			continue
+		}
+		state := stateName(snap.timestamp)
+		if err := os.Remove(filepath.Join(s.dir, state)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("pruning binary snapshot", "file", state, "err", err)
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		slog.Info("pruned old snapshots", "count", pruned, "kept", len(snapshots)-pruned)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+)
+
+// Spectators connect with ?spectator=1 to watch without painting, e.g. big
+// screens and public embeds. They get syncs and broadcasts like any client
+// but no color and no session, so they never hold a cooldown or a resumable
+// slot. Updates from them are answered with updateSpectator, undos with
+// nothing undone, and chat is refused.
+
+// updateSpectator is the MsgTypeUpdateAck result for an update sent by a
+// spectator.
+const updateSpectator = 4
+
+// spectatorAllows reports whether a spectator may send msgType, answering
+// updates with a MsgTypeUpdateAck carrying updateSpectator and undos with a
+// MsgTypeUndoAck carrying 0.
+func (c *Client) spectatorAllows(msgType byte) bool {
+	switch msgType {
+	case MsgTypeUpdate, MsgTypeUpdatePalette, MsgTypeBatchUpdate:
+		c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUpdateAck, updateSpectator}})
+	case MsgTypeUndo:
+		c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUndoAck, 0}})
+	case MsgTypeSetColor, MsgTypeCooldownQuery:
+	default:
+		return true
+	}
+	slog.Debug("message not allowed for spectator", "remote_ip", c.ip, "type", msgType)
+	return false
+}
+
+// spectatorControls are the control messages spectators may not send.
+var spectatorControls = map[string]bool{
+	"chat":         true,
+	"set_nickname": true,
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// statsTTL is how long /stats serves a cached result before scanning
+	// the canvas again.
+	statsTTL = 5 * time.Second
+	// statsTopColors is the number of colors in the /stats histogram.
+	statsTopColors = 32
+)
+
+// colorCount is an entry of the /stats color histogram.
+type colorCount struct {
+	Color  string `json:"color"` // "#rrggbb"
+	Pixels int    `json:"pixels"`
+}
+
+// canvasStats is the JSON body of /stats.
+type canvasStats struct {
+	Pixels  int     `json:"pixels"`
+	Painted int     `json:"painted"`
+	Fill    float64 `json:"fill_percent"`
+	// Colors are the most used colors among painted pixels, most used
+	// first.
+	Colors []colorCount `json:"colors"`
+	// Computed is when the canvas was scanned, in Unix milliseconds.
+	Computed int64 `json:"computed"`
+}
+
+// computeCanvasStats scans every panel under its read lock. A pixel counts
+// as painted if it has a timestamp or is not the background color; pixels
+// of the background color restored from a PNG snapshot, which carries no
+// timestamps, are therefore counted as blank.
+func computeCanvasStats() canvasStats {
+	counts := make(map[[3]byte]int)
+	painted := 0
+	for i := range panels {
+		panelLocks[i].RLock()
+		for y := range panels[i] {
+			row := panels[i][y]
+			for x := range row {
+				p := &row[x]
+				if p.R == background.R && p.G == background.G && p.B == background.B && p.Timestamp() == 0 {
+					continue
+				}
+				painted++
+				counts[[3]byte{p.R, p.G, p.B}]++
+			}
+		}
+		panelLocks[i].RUnlock()
+	}
+
+	colors := make([]colorCount, 0, len(counts))
+	for c, n := range counts {
+		colors = append(colors, colorCount{Color: fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2]), Pixels: n})
+	}
+	sort.Slice(colors, func(i, j int) bool {
+		if colors[i].Pixels != colors[j].Pixels {
+			return colors[i].Pixels > colors[j].Pixels
+		}
+		return colors[i].Color < colors[j].Color
+	})
+	if len(colors) > statsTopColors {
+		colors = colors[:statsTopColors]
+	}
+
+	total := numPanels * panelSize * panelSize
+	return canvasStats{
+		Pixels:   total,
+		Painted:  painted,
+		Fill:     100 * float64(painted) / float64(total),
+		Colors:   colors,
+		Computed: time.Now().UnixMilli(),
+	}
+}
+
+// statsCache holds the encoded /stats body for statsTTL. Scanning the
+// canvas takes a while, so concurrent requests for a stale body wait for a
+// single scan.
+var statsCache struct {
+	mu       sync.Mutex
+	body     []byte
+	computed time.Time
+}
+
+// serveStats reports how much of the canvas is painted and with which
+// colors, for dashboards.
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statsCache.mu.Lock()
+	if statsCache.body == nil || time.Since(statsCache.computed) >= statsTTL {
+		body, err := json.Marshal(computeCanvasStats())
+		if err != nil {
+			statsCache.mu.Unlock()
+			slog.Error("encoding stats", "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		statsCache.body = append(body, '\n')
+		statsCache.computed = time.Now()
+	}
+	body := statsCache.body
+	statsCache.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(statsTTL/time.Second)))
+	w.Write(body)
+}
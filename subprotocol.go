@@ -0,0 +1,52 @@
+package main
+
+// Websocket subprotocols, offered by clients in Sec-WebSocket-Protocol. The
+// server picks the newest one the client offers and echoes it in the
+// handshake. Clients that offer none are legacy frontends: they keep the
+// behaviour of the query parameters they pass, as before subprotocols were
+// introduced.
+const (
+	// subprotocolV1 is the original message set: single pixel updates and
+	// full panel syncs with MsgTypePanelSync. Batches, deltas, compressed
+	// broadcasts and encoded syncs are refused even if the query asks for
+	// them.
+	subprotocolV1 = "pxpx-v1"
+	// subprotocolV2 adds MsgTypeBatchUpdate, MsgTypeDeltaRequest and
+	// compression: MsgTypeCompressed broadcasts and zlib panel syncs are on
+	// without ?compress=1 or ?sync-encoding, which may still pick another
+	// sync encoding.
+	subprotocolV2 = "pxpx-v2"
+)
+
+// subprotocols lists the supported subprotocols, most preferred first, as
+// websocket.Upgrader expects.
+var subprotocols = []string{subprotocolV2, subprotocolV1}
+
+// applySubprotocol sets the capabilities of c from the subprotocol
+// negotiated on its connection.
+func (c *Client) applySubprotocol() {
+	switch c.subprotocol {
+	case subprotocolV1:
+		c.compress = false
+		c.encodedSync = false
+	case subprotocolV2:
+		c.compress = true
+		if !c.encodedSync {
+			c.encodedSync = true
+			c.syncEncoding = encodingZlib
+		}
+	}
+}
+
+// allowsMessage reports whether msgType may be sent by c under its
+// subprotocol.
+func (c *Client) allowsMessage(msgType byte) bool {
+	if c.subprotocol != subprotocolV1 {
+		return true
+	}
+	switch msgType {
+	case MsgTypeBatchUpdate, MsgTypeDeltaRequest:
+		return false
+	}
+	return true
+}
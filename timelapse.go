@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	colorpalette "image/color/palette"
+	"image/gif"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultTimelapseFrames caps the frames of /timelapse.gif unless the
+	// request asks otherwise; longer archives are sampled evenly.
+	defaultTimelapseFrames = 300
+	// defaultTimelapseDelay is the delay between frames in 100ths of a
+	// second.
+	defaultTimelapseDelay = 10
+)
+
+// timelapseFrame scales img down to width pixels wide, keeping its aspect
+// ratio, and maps it onto the web-safe palette. Sampling is nearest
+// neighbour, which keeps pixel art crisp, and the palette index is computed
+// directly rather than searched for each pixel.
+func timelapseFrame(img image.Image, width int) *image.Paletted {
+	b := img.Bounds()
+	width = min(width, b.Dx())
+	height := max(1, b.Dy()*width/b.Dx())
+	frame := image.NewPaletted(image.Rect(0, 0, width, height), colorpalette.WebSafe)
+	for y := 0; y < height; y++ {
+		sy := b.Min.Y + y*b.Dy()/height
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x*b.Dx()/width, sy).RGBA()
+			// Round each 16-bit channel to the nearest of the six levels.
+			ri := (r*5 + 0x7fff) / 0xffff
+			gi := (g*5 + 0x7fff) / 0xffff
+			bi := (bl*5 + 0x7fff) / 0xffff
+			frame.Pix[frame.PixOffset(x, y)] = uint8(ri*36 + gi*6 + bi)
+		}
+	}
+	return frame
+}
+
+// serveTimelapse assembles the full snapshots in store into an animated
+// GIF, oldest first, each frame scaled to width pixels wide. ?frames limits
+// the number of frames (default defaultTimelapseFrames) and ?delay sets the
+// delay between them in 100ths of a second. A single snapshot yields a
+// still image; no snapshot at all is a 404.
+func serveTimelapse(store SnapshotStore, width int, w http.ResponseWriter, r *http.Request) {
+	maxFrames := defaultTimelapseFrames
+	if v := r.URL.Query().Get("frames"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid frames", http.StatusBadRequest)
+			return
+		}
+		maxFrames = n
+	}
+	delay := defaultTimelapseDelay
+	if v := r.URL.Query().Get("delay"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 65535 {
+			http.Error(w, "Invalid delay", http.StatusBadRequest)
+			return
+		}
+		delay = n
+	}
+
+	timestamps, err := store.List()
+	if err != nil {
+		slog.Error("listing snapshots", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(timestamps) > maxFrames {
+		sampled := make([]int64, maxFrames)
+		for i := range sampled {
+			sampled[i] = timestamps[i*len(timestamps)/maxFrames]
+		}
+		// Always end on the latest state of the canvas.
+		sampled[maxFrames-1] = timestamps[len(timestamps)-1]
+		timestamps = sampled
+	}
+
+	anim := &gif.GIF{}
+	for _, ts := range timestamps {
+		img, err := store.Load(ts)
+		if err != nil {
+			slog.Warn("skipping unreadable snapshot", "timestamp", ts, "err", err)
+			continue
+		}
+		anim.Image = append(anim.Image, timelapseFrame(img, width))
+		anim.Delay = append(anim.Delay, delay)
+	}
+	if len(anim.Image) == 0 {
+		http.Error(w, "No snapshots", http.StatusNotFound)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		slog.Error("encoding timelapse", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTurnstileCacheTTL is how long Cloudflare considers a Turnstile token
+// valid. Cached verifications never outlive it.
+const maxTurnstileCacheTTL = 300 * time.Second
+
+// turnstileCache remembers recently verified Turnstile tokens so a client
+// reconnecting with the same token shortly after does not trigger another
+// siteverify round-trip. Entries are bound to the IP that verified them.
+type turnstileCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]turnstileEntry
+}
+
+type turnstileEntry struct {
+	ip      string
+	expires time.Time
+}
+
+func newTurnstileCache(ttl time.Duration) *turnstileCache {
+	return &turnstileCache{
+		ttl:     min(ttl, maxTurnstileCacheTTL),
+		entries: make(map[string]turnstileEntry),
+	}
+}
+
+// verified reports whether token was verified for ip within the TTL.
+func (tc *turnstileCache) verified(token, ip string) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	e, ok := tc.entries[token]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.expires) {
+		delete(tc.entries, token)
+		return false
+	}
+	return e.ip == ip
+}
+
+// add records a successful verification of token for ip and drops expired
+// entries.
+func (tc *turnstileCache) add(token, ip string) {
+	now := time.Now()
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for t, e := range tc.entries {
+		if now.After(e.expires) {
+			delete(tc.entries, t)
+		}
+	}
+	tc.entries[token] = turnstileEntry{ip: ip, expires: now.Add(tc.ttl)}
+}
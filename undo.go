@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// undoEntry remembers a client's last single-pixel placement and the pixel
+// it replaced, so that MsgTypeUndo can put the pixel back.
+type undoEntry struct {
+	panel, x, y int
+	// ts is the timestamp of the placement; the pixel still has it if no
+	// one painted over it since.
+	ts   int64
+	prev Pixel
+}
+
+// undoLast reverts c's last placement to the pixel it replaced and
+// broadcasts the revert like an update. It is rejected if there is nothing
+// to undo, the pixel was painted over since or its panel got locked. A
+// placement can be undone once; batches cannot be undone. Only readPump may
+// call it.
+func (c *Client) undoLast() {
+	u := c.undo
+	c.undo = nil
+	if u == nil || lockedPanels[u.panel].Load() {
+		c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUndoAck, 0}})
+		return
+	}
+
+	accepted := time.Now()
+	// The revert must be newer than the placement to win over it.
+	now := max(accepted.UnixMilli(), u.ts+1)
+	panelLocks[u.panel].Lock()
+	p := &panels[u.panel][u.y][u.x]
+	reverted := p.Owner == c.id && p.Timestamp() == u.ts &&
+		setPixel(u.panel, u.x, u.y, u.prev.R, u.prev.G, u.prev.B, u.prev.Owner, now)
+	panelLocks[u.panel].Unlock()
+	if !reverted {
+		slog.Debug("undo rejected: pixel painted over", "remote_ip", c.ip, "panel", u.panel, "x", u.x, "y", u.y)
+		c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUndoAck, 0}})
+		return
+	}
+
+	pixelUpdatesTotal.Inc()
+	c.hub.activity.record(u.panel, 1)
+	pl := placement{Panel: uint16(u.panel), X: uint8(u.x), Y: uint8(u.y), R: u.prev.R, G: u.prev.G, B: u.prev.B, Timestamp: now, Owner: u.prev.Owner}
+	if c.hub.history != nil {
+		c.hub.history.add(pl)
+	}
+	c.hub.accessLog.placement(c, pl)
+	c.hub.placementLog.record(pl, sessionHash(c.session))
+	slog.Debug("placement undone", "remote_ip", c.ip, "panel", u.panel, "x", u.x, "y", u.y)
+	c.hub.broadcastPlacement(broadcastMessage(u.panel, u.x, u.y, u.prev.R, u.prev.G, u.prev.B, now), accepted)
+	c.queue(OutgoingMessage{messageType: websocket.BinaryMessage, data: []byte{MsgTypeUndoAck, 1}})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
+// A client viewing part of the canvas can subscribe to the panels in view
+// with the control message
+//
+//	{"type": "subscribe", "panels": [0, 1, 28, 29]}
+//
+// after which the hub only forwards it broadcasts about those panels. A
+// null or missing panels list subscribes to the whole canvas again, which
+// is also the default. Messages that are not about particular panels, such
+// as client counts and canvas resets, always go out.
+
+// viewport is the set of panels a client subscribed to. A nil *viewport
+// subscribes to every panel.
+type viewport []bool
+
+// wants reports whether a client subscribed to v gets a broadcast about
+// panels; nil panels, a broadcast about no panel in particular, always
+// goes out.
+func (v *viewport) wants(panels []int) bool {
+	if v == nil || panels == nil {
+		return true
+	}
+	for _, p := range panels {
+		if p < len(*v) && (*v)[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastPanels returns the panels a broadcast updates, or nil if it is
+// not a pixel update and goes to every client.
+func broadcastPanels(data []byte) []int {
+	if len(data) == 0 {
+		return nil
+	}
+	switch data[0] {
+	case MsgTypeBroadcast:
+		if len(data) >= 3 {
+			return []int{int(binary.BigEndian.Uint16(data[1:3]))}
+		}
+	case MsgTypeBatchBroadcast:
+		panels := []int{}
+		for e := data[min(14, len(data)):]; len(e) >= 4; e = e[4:] {
+			panels = append(panels, int(binary.BigEndian.Uint16(e[0:2])))
+		}
+		return panels
+	}
+	return nil
+}
+
+// handleControlSubscribe sets the client's viewport and answers
+// {"type": "subscribed", "panels": n}, n being -1 for every panel.
+func handleControlSubscribe(c *Client, raw []byte) {
+	var req struct {
+		Panels []int `json:"panels"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		c.controlError("invalid subscription")
+		return
+	}
+	var v *viewport
+	n := -1
+	if req.Panels != nil {
+		subscribed := make(viewport, numPanels)
+		n = 0
+		for _, p := range req.Panels {
+			if p < 0 || p >= numPanels {
+				c.controlError("panel out of range")
+				return
+			}
+			if !subscribed[p] {
+				subscribed[p] = true
+				n++
+			}
+		}
+		v = &subscribed
+	}
+	c.viewport.Store(v)
+	c.sendControl(struct {
+		Type   string `json:"type"`
+		Panels int    `json:"panels"`
+	}{"subscribed", n})
+}